@@ -19,30 +19,26 @@ func (cfg *apiConfig) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user, validateErr := cfg.db.AuthenticateUser(reqBody.Email, reqBody.Password)
-	if validateErr == nil {
-		signedAccessToken, accessErr := generateAccessToken(user.Id, cfg.jwtSecret)
-		if accessErr != nil {
-			respondWithError(w, 500, accessErr.Error())
-			return
-		}
-		signedRefreshToken, refreshErr := generateRefreshToken(user.Id, cfg.jwtSecret)
-		if refreshErr != nil {
-			respondWithError(w, 500, accessErr.Error())
-			return
-		}
-		type UserWithTokens struct {
-			fsdb.User
-			AccessToken  string `json:"token"`
-			RefreshToken string `json:"refresh_token"`
-		}
-		respondWithJSON(w, 200, UserWithTokens{user, signedAccessToken, signedRefreshToken})
-	} else if validateErr.Error() == string(fsdb.IncorrectPassword) {
-		respondWithError(w, 401, "Password didn't match")
-	} else if validateErr.Error() == string(fsdb.UserNotExist) {
-		respondWithError(w, 401, "No user with that email")
-	} else {
-		respondWithError(w, 500, validateErr.Error())
+	if validateErr != nil {
+		respondWithStoreError(w, validateErr)
+		return
+	}
+	signedAccessToken, accessErr := cfg.generateAccessToken(user.Id)
+	if accessErr != nil {
+		respondWithError(w, 500, accessErr.Error())
+		return
+	}
+	signedRefreshToken, refreshErr := cfg.generateRefreshToken(user.Id)
+	if refreshErr != nil {
+		respondWithError(w, 500, refreshErr.Error())
+		return
 	}
+	type UserWithTokens struct {
+		fsdb.User
+		AccessToken  string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	respondWithJSON(w, 200, UserWithTokens{user, signedAccessToken, signedRefreshToken})
 }
 
 func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, r *http.Request) {
@@ -61,7 +57,7 @@ func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, r *http.Request) {
 	if idErr != nil {
 		respondWithError(w, 500, idErr.Error())
 	}
-	accesToken, tokenErr := generateAccessToken(userId, cfg.jwtSecret)
+	accesToken, tokenErr := cfg.generateAccessToken(userId)
 	if tokenErr != nil {
 		respondWithJSON(w, 500, tokenErr.Error())
 	}
@@ -82,9 +78,15 @@ func (cfg *apiConfig) revokeHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 401, validationErr.Error())
 		return
 	}
-	revokeErr := cfg.db.RevokeToken(refreshToken)
+	expiresAt, expirationErr := token.Claims.GetExpirationTime()
+	if expirationErr != nil || expiresAt == nil {
+		respondWithError(w, 401, "Token has no expiration time")
+		return
+	}
+	revokeErr := cfg.db.RevokeToken(refreshToken, expiresAt.Time)
 	if revokeErr != nil {
-		respondWithError(w, 500, revokeErr.Error())
+		respondWithStoreError(w, revokeErr)
+		return
 	}
 	w.WriteHeader(200)
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fsdb"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (cfg *apiConfig) backupsPostHandler(w http.ResponseWriter, r *http.Request) {
+	backup, backupErr := fsdb.WriteBackup(cfg.db, cfg.backupDir, cfg.backupsKept)
+	if backupErr != nil {
+		respondWithStoreError(w, backupErr)
+		return
+	}
+	respondWithJSON(w, 201, backup)
+}
+
+func (cfg *apiConfig) backupsGetHandler(w http.ResponseWriter, r *http.Request) {
+	backups, listErr := fsdb.ListBackups(cfg.backupDir)
+	if listErr != nil {
+		respondWithStoreError(w, listErr)
+		return
+	}
+	respondWithJSON(w, 200, backups)
+}
+
+func (cfg *apiConfig) backupsRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	restoreErr := fsdb.RestoreBackup(cfg.db, cfg.backupDir, chi.URLParam(r, "backupName"))
+	if restoreErr != nil {
+		respondWithStoreError(w, restoreErr)
+		return
+	}
+	w.WriteHeader(200)
+}
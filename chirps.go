@@ -1,37 +1,30 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"fsdb"
+	"log"
 	"net/http"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
 
 func (cfg *apiConfig) chirpsPostHandler(w http.ResponseWriter, r *http.Request) {
-	authHeader := strings.Split(r.Header.Get("Authorization"), " ")
-	if len(authHeader) < 2 || authHeader[0] != "Bearer" {
-		respondWithError(w, 401, "Missing authorization")
-		return
-	}
-	accessToken := authHeader[1]
-	parsedToken, validationErr := cfg.validateToken(accessToken, string(TokenTypeAccess))
-	if validationErr != nil {
-		respondWithError(w, 401, validationErr.Error())
-		return
-	}
-	userId, idErr := getUserId(parsedToken)
-	if idErr != nil {
-		respondWithError(w, 500, idErr.Error())
+	userId, ok := cfg.authenticateAccess(w, r)
+	if !ok {
 		return
 	}
 	decoder := json.NewDecoder(r.Body)
 	reqBody := struct {
-		Body string `json:"body"`
+		Body      string `json:"body"`
+		InReplyTo string `json:"in_reply_to"`
 	}{}
 	decoderErr := decoder.Decode(&reqBody)
 	if decoderErr != nil {
@@ -44,86 +37,233 @@ func (cfg *apiConfig) chirpsPostHandler(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, 400, validationErr.Error())
 		return
 	}
-	chirp, createErr := cfg.db.CreateChirp(cleanBody, userId)
+	var chirp fsdb.Chirp
+	var createErr error
+	if reqBody.InReplyTo == "" {
+		chirp, createErr = cfg.db.CreateChirp(cleanBody, userId)
+	} else {
+		chirp, createErr = cfg.db.CreateReply(cleanBody, userId, reqBody.InReplyTo)
+	}
 	if createErr != nil {
-		respondWithError(w, 500, createErr.Error())
+		respondWithStoreError(w, createErr)
+		return
 	}
 	respondWithJSON(w, 201, chirp)
 }
 
+const (
+	defaultChirpPageSize = 100
+	maxChirpPageSize     = 1000
+)
+
+// chirpsGetHandler lists chirps a page at a time, oldest first unless
+// sort=desc. If there are more, a Link header with rel="next" points to the
+// next page.
 func (cfg *apiConfig) chirpsGetHandler(w http.ResponseWriter, r *http.Request) {
-	authorIdParam := r.URL.Query().Get("author_id")
-	var chirps []fsdb.Chirp
-	var getErr error
-	if len(authorIdParam) == 0 {
-		chirps, getErr = cfg.db.GetChirps()
-	} else {
-		authorId, convErr := strconv.Atoi(authorIdParam)
-		if convErr != nil {
-			respondWithError(w, 500, convErr.Error())
+	cfg.respondWithChirpPage(w, r, fsdb.ChirpQuery{AuthorId: r.URL.Query().Get("author_id")})
+}
+
+// hashtagChirpsGetHandler lists the chirps with a hashtag like
+// chirpsGetHandler.
+func (cfg *apiConfig) hashtagChirpsGetHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.respondWithChirpPage(w, r, fsdb.ChirpQuery{
+		AuthorId: r.URL.Query().Get("author_id"),
+		Hashtag:  chi.URLParam(r, "hashtag"),
+	})
+}
+
+// mentionsGetHandler lists the chirps mentioning a user like
+// chirpsGetHandler.
+func (cfg *apiConfig) mentionsGetHandler(w http.ResponseWriter, r *http.Request) {
+	userId := chi.URLParam(r, "userId")
+	if _, getErr := cfg.db.GetUser(userId); getErr != nil {
+		respondWithStoreError(w, getErr)
+		return
+	}
+	cfg.respondWithChirpPage(w, r, fsdb.ChirpQuery{
+		AuthorId:        r.URL.Query().Get("author_id"),
+		MentionedUserId: userId,
+	})
+}
+
+// respondWithChirpPage completes query with the paging parameters of the
+// request and responds with the page it selects.
+func (cfg *apiConfig) respondWithChirpPage(w http.ResponseWriter, r *http.Request, query fsdb.ChirpQuery) {
+	query.Descending = r.URL.Query().Get("sort") == "desc"
+	var paramErr error
+	if query.Limit, paramErr = parseLimitParam(r); paramErr != nil {
+		respondWithError(w, 400, paramErr.Error())
+		return
+	}
+	if query.Since, paramErr = parseTimeParam(r, "since"); paramErr != nil {
+		respondWithError(w, 400, paramErr.Error())
+		return
+	}
+	if query.Until, paramErr = parseTimeParam(r, "until"); paramErr != nil {
+		respondWithError(w, 400, paramErr.Error())
+		return
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		after, afterCreatedAt, cursorErr := decodeChirpCursor(cursor, query.Descending)
+		if cursorErr != nil {
+			respondWithError(w, 400, cursorErr.Error())
 			return
 		}
-		chirps, getErr = cfg.db.GetChirpsFromAuthor(authorId)
+		query.After, query.AfterCreatedAt = after, afterCreatedAt
 	}
+
+	page, getErr := cfg.db.GetChirpPage(query)
 	if getErr != nil {
-		respondWithError(w, 500, getErr.Error())
+		respondWithStoreError(w, getErr)
 		return
 	}
-	sort := r.URL.Query().Get("sort")
-	if sort == "desc" {
-		slices.Reverse(chirps)
+	if page.Chirps == nil {
+		page.Chirps = []fsdb.Chirp{}
 	}
-	respondWithJSON(w, 200, chirps)
+	if page.More {
+		setNextLink(w, r, encodeChirpCursor(page.Chirps[len(page.Chirps)-1], query.Descending))
+	}
+	respondWithJSON(w, 200, page.Chirps)
 }
 
-func (cfg *apiConfig) chirpsGetUniqueHandler(w http.ResponseWriter, r *http.Request) {
-	chirpId, atoiErr := strconv.Atoi(chi.URLParam(r, "chirpId"))
+// setNextLink adds a Link header pointing to the next page, which is the
+// requested one with cursor in place of the current cursor.
+func setNextLink(w http.ResponseWriter, r *http.Request, cursor string) {
+	next := *r.URL
+	params := next.Query()
+	params.Set("cursor", cursor)
+	next.RawQuery = params.Encode()
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+}
+
+// parseLimitParam reads the page size from the query string.
+func parseLimitParam(r *http.Request) (int, error) {
+	limitParam := r.URL.Query().Get("limit")
+	if limitParam == "" {
+		return defaultChirpPageSize, nil
+	}
+	limit, atoiErr := strconv.Atoi(limitParam)
+	if atoiErr != nil || limit < 1 || limit > maxChirpPageSize {
+		return 0, fmt.Errorf("Invalid limit, expected a number from 1 to %d", maxChirpPageSize)
+	}
+	return limit, nil
+}
+
+// A chirp cursor names the last chirp of a page by its creation time and id,
+// which is where it sits in a listing, along with the sort order it was
+// listed in, so it can't be used to continue a listing the other way.
+// Clients must treat it as opaque.
+func encodeChirpCursor(last fsdb.Chirp, descending bool) string {
+	order := "asc"
+	if descending {
+		order = "desc"
+	}
+	position := strconv.FormatInt(last.CreatedAt.UnixNano(), 10) + ":" + last.Id
+	return base64.RawURLEncoding.EncodeToString([]byte(order + ":" + position))
+}
+
+func decodeChirpCursor(cursor string, descending bool) (string, time.Time, error) {
+	decoded, decodeErr := base64.RawURLEncoding.DecodeString(cursor)
+	if decodeErr != nil {
+		return "", time.Time{}, errors.New("Invalid cursor")
+	}
+	parts := strings.SplitN(string(decoded), ":", 3)
+	if len(parts) != 3 || parts[2] == "" || (parts[0] != "asc" && parts[0] != "desc") {
+		return "", time.Time{}, errors.New("Invalid cursor")
+	}
+	createdAt, atoiErr := strconv.ParseInt(parts[1], 10, 64)
 	if atoiErr != nil {
-		respondWithError(w, 500, atoiErr.Error())
+		return "", time.Time{}, errors.New("Invalid cursor")
+	}
+	if (parts[0] == "desc") != descending {
+		return "", time.Time{}, errors.New("Cursor belongs to a listing in the other sort order")
+	}
+	return parts[2], time.Unix(0, createdAt).UTC(), nil
+}
+
+// parseTimeParam reads an optional RFC 3339 timestamp from the query string.
+// A missing parameter yields the zero time.
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return time.Time{}, nil
 	}
+	parsed, parseErr := time.Parse(time.RFC3339, param)
+	if parseErr != nil {
+		return time.Time{}, fmt.Errorf("Invalid %s, expected an RFC 3339 timestamp", name)
+	}
+	return parsed, nil
+}
+
+func (cfg *apiConfig) chirpsGetUniqueHandler(w http.ResponseWriter, r *http.Request) {
+	chirpId := chi.URLParam(r, "chirpId")
 	chirp, getErr := cfg.db.GetUniqueChirp(chirpId)
 	if getErr != nil {
-		if getErr.Error() == "Invalid chirp id" {
-			respondWithError(w, 404, "Chirp does not exist")
-			return
-		}
-		respondWithError(w, 500, getErr.Error())
+		respondWithStoreError(w, getErr)
 		return
 	}
 	respondWithJSON(w, 200, chirp)
 }
 
+// chirpsThreadHandler responds with the conversation a chirp is part of, from
+// the chirp that started it down to the latest replies.
+func (cfg *apiConfig) chirpsThreadHandler(w http.ResponseWriter, r *http.Request) {
+	thread, getErr := cfg.db.GetThread(chi.URLParam(r, "chirpId"))
+	if getErr != nil {
+		respondWithStoreError(w, getErr)
+		return
+	}
+	respondWithJSON(w, 200, thread)
+}
+
 func (cfg *apiConfig) chirpsDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	authHeader := strings.Split(r.Header.Get("Authorization"), " ")
-	if len(authHeader) < 2 || authHeader[0] != "Bearer" {
-		respondWithError(w, 401, "Missing authorization")
+	userId, ok := cfg.authenticateAccess(w, r)
+	if !ok {
 		return
 	}
-	accessToken := authHeader[1]
-	parsedToken, validationErr := cfg.validateToken(accessToken, string(TokenTypeAccess))
-	if validationErr != nil {
-		respondWithError(w, 401, validationErr.Error())
+	chirpId := chi.URLParam(r, "chirpId")
+	deleteErr := cfg.db.DeleteChirp(chirpId, userId)
+	if deleteErr != nil {
+		respondWithStoreError(w, deleteErr)
 		return
 	}
-	userId, idErr := getUserId(parsedToken)
-	if idErr != nil {
-		respondWithError(w, 500, idErr.Error())
+	w.WriteHeader(200)
+}
+
+func (cfg *apiConfig) chirpsUndeleteHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := cfg.authenticateAccess(w, r)
+	if !ok {
 		return
 	}
-	chirpId, atoiErr := strconv.Atoi(chi.URLParam(r, "chirpId"))
-	if atoiErr != nil {
-		respondWithError(w, 500, atoiErr.Error())
+	chirpId := chi.URLParam(r, "chirpId")
+	chirp, undeleteErr := cfg.db.UndeleteChirp(chirpId, userId, undeleteGracePeriod)
+	if undeleteErr != nil {
+		respondWithStoreError(w, undeleteErr)
+		return
 	}
-	deleteErr := cfg.db.DeleteChirp(chirpId, userId)
-	if deleteErr != nil {
-		if deleteErr.Error() == string(fsdb.Unauthorized) {
-			respondWithError(w, 403, deleteErr.Error())
-			return
-		}
-		respondWithError(w, 500, deleteErr.Error())
+	respondWithJSON(w, 200, chirp)
+}
+
+func (cfg *apiConfig) deletedChirpsGetHandler(w http.ResponseWriter, r *http.Request) {
+	chirps, getErr := cfg.db.GetDeletedChirps()
+	if getErr != nil {
+		respondWithStoreError(w, getErr)
 		return
 	}
-	w.WriteHeader(200)
+	respondWithJSON(w, 200, chirps)
+}
+
+// purgeDeletedChirps periodically removes chirps that were deleted longer
+// than retention ago. It never returns.
+func (cfg *apiConfig) purgeDeletedChirps(interval, retention time.Duration) {
+	for range time.Tick(interval) {
+		purged, purgeErr := cfg.db.PurgeDeletedChirps(time.Now().Add(-retention))
+		if purgeErr != nil {
+			log.Printf("Could not purge deleted chirps: %s", purgeErr)
+		} else if purged > 0 {
+			log.Printf("Purged %d deleted chirps", purged)
+		}
+	}
 }
 
 func validateChirp(chirpBody string) (string, error) {
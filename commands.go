@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"fsdb"
+	"io"
+	"os"
+)
+
+const commandUsage = `usage:
+  chirpy [flags] backup create
+  chirpy [flags] backup list
+  chirpy [flags] backup restore <name>
+  chirpy [flags] export [file]
+  chirpy [flags] import [-on-conflict fail|skip|overwrite] [-keep-ids] [file]
+  chirpy [flags] verify [-repair]
+  chirpy [flags] genkey
+  chirpy [flags] rotate-key
+
+export writes to stdout and import reads from stdin unless a file is given.
+rotate-key re-encrypts the database and its backups from DB_ENCRYPTION_KEY
+to DB_NEW_ENCRYPTION_KEY; either may be empty for no encryption.`
+
+// commandContext locates the data maintenance commands work on.
+type commandContext struct {
+	dbPath           string
+	encryptionKey    []byte
+	sharded          bool
+	chirpSegmentSize int
+	backupDir        string
+	backupsKept      int
+}
+
+// runCommand executes a maintenance command instead of starting the server.
+func runCommand(args []string, ctx commandContext) error {
+	if len(args) == 0 {
+		return errors.New(commandUsage)
+	}
+	switch args[0] {
+	case "backup":
+		return runBackupCommand(args[1:], ctx)
+	case "export":
+		return runExportCommand(args[1:], ctx)
+	case "import":
+		return runImportCommand(args[1:], ctx)
+	case "verify":
+		return runVerifyCommand(args[1:], ctx)
+	case "genkey":
+		key, keyErr := fsdb.GenerateKey()
+		if keyErr != nil {
+			return keyErr
+		}
+		fmt.Println(key)
+		return nil
+	case "rotate-key":
+		return runRotateKeyCommand(ctx)
+	default:
+		return errors.New(commandUsage)
+	}
+}
+
+// openDB opens the database for a command. Commands that write need the
+// database to themselves; remedy tells the user what to do instead while a
+// server is running. Commands that copy the database open it Consistent.
+func (ctx commandContext) openDB(options fsdb.Options, remedy string) (*fsdb.DB, error) {
+	options.EncryptionKey = ctx.encryptionKey
+	options.Sharded = ctx.sharded
+	options.ChirpSegmentSize = ctx.chirpSegmentSize
+	db, openErr := fsdb.Open(ctx.dbPath, options)
+	if errors.Is(openErr, fsdb.ErrLocked) {
+		return nil, fmt.Errorf("%w; %s", openErr, remedy)
+	}
+	if errors.Is(openErr, fsdb.ErrLiveSnapshot) {
+		return nil, fmt.Errorf("%w; stop the server or run it with -journal to copy a sharded database", openErr)
+	}
+	return db, openErr
+}
+
+func runBackupCommand(args []string, ctx commandContext) error {
+	if len(args) == 0 {
+		return errors.New(commandUsage)
+	}
+	switch args[0] {
+	case "create":
+		// A read-only view is a consistent snapshot even while a server has
+		// the database open, unless the server rewrites several shards per
+		// write without a journal; Consistent refuses that case.
+		db, openErr := ctx.openDB(fsdb.Options{ReadOnly: true, Consistent: true}, "")
+		if openErr != nil {
+			return openErr
+		}
+		defer db.Close()
+		backup, backupErr := fsdb.WriteBackup(db, ctx.backupDir, ctx.backupsKept)
+		if backupErr != nil {
+			return backupErr
+		}
+		fmt.Printf("Created backup %s\n", backup.Name)
+	case "list":
+		backups, listErr := fsdb.ListBackups(ctx.backupDir)
+		if listErr != nil {
+			return listErr
+		}
+		for _, backup := range backups {
+			fmt.Printf("%s\t%s\t%d bytes\n", backup.Name, backup.CreatedAt.Local().Format("2006-01-02 15:04:05"), backup.Size)
+		}
+	case "restore":
+		if len(args) < 2 {
+			return errors.New(commandUsage)
+		}
+		db, openErr := ctx.openDB(fsdb.Options{}, "restore through POST /admin/backups/{name}/restore instead")
+		if openErr != nil {
+			return openErr
+		}
+		defer db.Close()
+		if restoreErr := fsdb.RestoreBackup(db, ctx.backupDir, args[1]); restoreErr != nil {
+			return restoreErr
+		}
+		fmt.Printf("Restored %s from backup %s\n", ctx.dbPath, args[1])
+	default:
+		return errors.New(commandUsage)
+	}
+	return nil
+}
+
+func runExportCommand(args []string, ctx commandContext) error {
+	// Like backup create, the export must not catch a write halfway.
+	db, openErr := ctx.openDB(fsdb.Options{ReadOnly: true, Consistent: true}, "")
+	if openErr != nil {
+		return openErr
+	}
+	defer db.Close()
+
+	var out io.Writer = os.Stdout
+	if len(args) > 0 {
+		file, createErr := os.Create(args[0])
+		if createErr != nil {
+			return createErr
+		}
+		defer file.Close()
+		out = file
+	}
+	buffered := bufio.NewWriter(out)
+	if exportErr := fsdb.Export(db, buffered); exportErr != nil {
+		return exportErr
+	}
+	return buffered.Flush()
+}
+
+func runImportCommand(args []string, ctx commandContext) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	onConflict := flags.String("on-conflict", "fail", "What to do with records that already exist: 'fail', 'skip' or 'overwrite'")
+	keepIds := flags.Bool("keep-ids", false, "Keep the ids from the export instead of assigning new ones")
+	if parseErr := flags.Parse(args); parseErr != nil {
+		return parseErr
+	}
+	policy, policyErr := fsdb.ParseConflictPolicy(*onConflict)
+	if policyErr != nil {
+		return policyErr
+	}
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		file, openErr := os.Open(flags.Arg(0))
+		if openErr != nil {
+			return openErr
+		}
+		defer file.Close()
+		in = file
+	}
+
+	db, openErr := ctx.openDB(fsdb.Options{}, "stop the server before importing")
+	if openErr != nil {
+		return openErr
+	}
+	defer db.Close()
+	report, importErr := fsdb.Import(db, in, fsdb.ImportOptions{OnConflict: policy, KeepIds: *keepIds})
+	if importErr != nil {
+		return importErr
+	}
+	fmt.Printf("Imported into %s: %s\n", ctx.dbPath, report)
+	return nil
+}
+
+// runVerifyCommand checks the database file against its checksum and the
+// collections against each other. With -repair, problems are fixed and the
+// current contents are accepted under a new checksum, which is how
+// deliberate edits to the file are made to stick.
+func runVerifyCommand(args []string, ctx commandContext) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "Fix the problems found and update the checksum")
+	if parseErr := flags.Parse(args); parseErr != nil {
+		return parseErr
+	}
+
+	checksumErr := fsdb.VerifyChecksum(ctx.dbPath, ctx.encryptionKey)
+	if checksumErr != nil && !errors.Is(checksumErr, fsdb.ErrChecksumMismatch) {
+		return fmt.Errorf("database is unreadable: %w", checksumErr)
+	}
+	if checksumErr != nil {
+		fmt.Println(checksumErr)
+	}
+
+	options := fsdb.Options{ReadOnly: !*repair, IgnoreChecksum: true}
+	db, openErr := ctx.openDB(options, "stop the server before repairing")
+	if openErr != nil {
+		return openErr
+	}
+	defer db.Close()
+
+	var problems []fsdb.IntegrityProblem
+	var verifyErr error
+	if *repair {
+		verifyErr = db.Update(func(tx *fsdb.Tx) error {
+			var repairErr error
+			problems, repairErr = tx.RepairIntegrity()
+			return repairErr
+		})
+	} else {
+		verifyErr = db.View(func(tx *fsdb.Tx) error {
+			var checkErr error
+			problems, checkErr = tx.CheckIntegrity()
+			return checkErr
+		})
+	}
+	if verifyErr != nil {
+		return verifyErr
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if checksumErr == nil && len(problems) == 0 {
+		fmt.Printf("%s is intact\n", ctx.dbPath)
+		return nil
+	}
+	if !*repair {
+		return errors.New("database has problems; run verify -repair to fix them")
+	}
+	// Repairs are written with a fresh checksum already; without any, the
+	// file has to be rewritten to accept its contents.
+	if len(problems) == 0 {
+		if compactErr := db.Compact(); compactErr != nil {
+			return compactErr
+		}
+	}
+	fmt.Printf("Repaired %s\n", ctx.dbPath)
+	return nil
+}
+
+func runRotateKeyCommand(ctx commandContext) error {
+	newKey, keyErr := fsdb.ParseKey(os.Getenv("DB_NEW_ENCRYPTION_KEY"))
+	if keyErr != nil {
+		return keyErr
+	}
+	db, openErr := ctx.openDB(fsdb.Options{}, "stop the server before rotating the key")
+	if openErr != nil {
+		return openErr
+	}
+	defer db.Close()
+	if rotateErr := db.RotateKey(newKey); rotateErr != nil {
+		return rotateErr
+	}
+	if rekeyErr := fsdb.RekeyBackups(ctx.backupDir, ctx.encryptionKey, newKey); rekeyErr != nil {
+		return fmt.Errorf("database was re-encrypted, but its backups weren't: %w", rekeyErr)
+	}
+	fmt.Printf("Re-encrypted %s and its backups; set DB_ENCRYPTION_KEY to the new key before restarting\n", ctx.dbPath)
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"fsdb"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// config holds everything chirpy runs with. Each setting is taken from the
+// first of these that has it: a command-line flag, an environment variable,
+// the selected profile of the config file, the top level of the config file,
+// and the built-in default.
+type config struct {
+	profile string
+
+	dataDir          string
+	backupDir        string
+	port             string
+	debug            bool
+	ephemeral        bool
+	store            string
+	journal          bool
+	sharded          bool
+	chirpSegmentSize int
+	ids              string
+	backupsKept      int
+	accessTokenTTL   time.Duration
+	refreshTokenTTL  time.Duration
+
+	jwtSecret     string
+	polkaApiKey   string
+	adminApiKey   string
+	encryptionKey []byte
+	keyText       string
+}
+
+// setting describes where a config value can come from besides its flag.
+// Secrets have no flag, so they don't show up in process listings.
+type setting struct {
+	env    string
+	secret bool
+}
+
+var settings = map[string]setting{
+	"data-dir":           {env: "CHIRPY_DATA_DIR"},
+	"backup-dir":         {env: "CHIRPY_BACKUP_DIR"},
+	"port":               {env: "CHIRPY_PORT"},
+	"debug":              {env: "CHIRPY_DEBUG"},
+	"ephemeral":          {env: "CHIRPY_EPHEMERAL"},
+	"store":              {env: "CHIRPY_STORE"},
+	"journal":            {env: "CHIRPY_JOURNAL"},
+	"sharded":            {env: "CHIRPY_SHARDED"},
+	"chirp-segment-size": {env: "CHIRPY_CHIRP_SEGMENT_SIZE"},
+	"ids":                {env: "CHIRPY_IDS"},
+	"backups-kept":       {env: "CHIRPY_BACKUPS_KEPT"},
+	"access-token-ttl":   {env: "CHIRPY_ACCESS_TOKEN_TTL"},
+	"refresh-token-ttl":  {env: "CHIRPY_REFRESH_TOKEN_TTL"},
+	"jwt-secret":         {env: "JWT_SECRET", secret: true},
+	"polka-api-key":      {env: "POLKA_API_KEY", secret: true},
+	"admin-api-key":      {env: "ADMIN_API_KEY", secret: true},
+	"db-encryption-key":  {env: "DB_ENCRYPTION_KEY", secret: true},
+}
+
+// configFile is the layout of the optional JSON config file. Keys are the
+// flag names; profiles override the top level for one environment each:
+//
+//	{"port": 8080, "profiles": {"test": {"debug": true, "port": 8081}}}
+type configFile struct {
+	settings map[string]json.RawMessage
+	profiles map[string]map[string]json.RawMessage
+}
+
+func (c *config) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	flags.StringVar(&c.dataDir, "data-dir", ".", "Directory the database lives in")
+	flags.StringVar(&c.backupDir, "backup-dir", "", "Directory backups are written to (default: backups in the data directory)")
+	flags.StringVar(&c.port, "port", "8080", "Port the server listens on")
+	flags.BoolVar(&c.debug, "debug", false, "Enable debug mode: use a separate database that is deleted on exit")
+	flags.BoolVar(&c.ephemeral, "ephemeral", false, "Delete the database when the server exits (default: on in debug mode)")
+	flags.StringVar(&c.store, "store", "file", "Storage backend: 'file' or 'memory'")
+	flags.BoolVar(&c.journal, "journal", false, "Append writes to a journal instead of rewriting the database file")
+	flags.BoolVar(&c.sharded, "sharded", false, "Keep each collection in its own file inside a database directory")
+	flags.IntVar(&c.chirpSegmentSize, "chirp-segment-size", 0, "With -sharded, split chirps into files of this many ids (0 keeps them in one file)")
+	flags.StringVar(&c.ids, "ids", "", "Ids for new users and chirps: 'sequential' or 'uuidv7' (default: keep the database's choice)")
+	flags.IntVar(&c.backupsKept, "backups-kept", 10, "Number of backups to keep (0 keeps all)")
+	flags.DurationVar(&c.accessTokenTTL, "access-token-ttl", time.Hour, "How long access tokens are valid")
+	flags.DurationVar(&c.refreshTokenTTL, "refresh-token-ttl", 60*24*time.Hour, "How long refresh tokens are valid")
+	flags.StringVar(&c.jwtSecret, "jwt-secret", "", "Secret tokens are signed with")
+	flags.StringVar(&c.polkaApiKey, "polka-api-key", "", "API key Polka webhooks authenticate with")
+	flags.StringVar(&c.adminApiKey, "admin-api-key", "", "API key for the admin endpoints")
+	flags.StringVar(&c.keyText, "db-encryption-key", "", "Key the database is encrypted with")
+	return flags
+}
+
+// loadConfig parses the command line and fills in the remaining settings from
+// the environment and the config file. It returns the arguments left after
+// the flags, which name a maintenance command if there are any.
+func loadConfig(args []string) (config, []string, error) {
+	var c config
+	all := c.flags()
+
+	commandLine := flag.NewFlagSet("chirpy", flag.ContinueOnError)
+	configPath := commandLine.String("config", "", "JSON config file to read settings from (env CHIRPY_CONFIG)")
+	commandLine.StringVar(&c.profile, "profile", "", "Profile of the config file to use (env CHIRPY_PROFILE)")
+	all.VisitAll(func(f *flag.Flag) {
+		if !settings[f.Name].secret {
+			commandLine.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	commandLine.Usage = func() {
+		fmt.Fprintf(commandLine.Output(), "Usage of chirpy:\n")
+		commandLine.PrintDefaults()
+		fmt.Fprintf(commandLine.Output(), "\nSecrets are read from JWT_SECRET, POLKA_API_KEY, ADMIN_API_KEY and\nDB_ENCRYPTION_KEY or the config file.\n\n%s\n", commandUsage)
+	}
+	if parseErr := commandLine.Parse(args); parseErr != nil {
+		return c, nil, parseErr
+	}
+
+	fromCommandLine := map[string]bool{}
+	commandLine.Visit(func(f *flag.Flag) { fromCommandLine[f.Name] = true })
+	if !fromCommandLine["profile"] {
+		c.profile = os.Getenv("CHIRPY_PROFILE")
+	}
+
+	// A profile can have its own .env file next to the shared one. Neither
+	// overrides variables that are set already.
+	if c.profile != "" {
+		if envErr := godotenv.Load(".env." + c.profile); envErr != nil && !errors.Is(envErr, os.ErrNotExist) {
+			return c, nil, envErr
+		}
+	}
+	godotenv.Load()
+	if !fromCommandLine["config"] {
+		*configPath = os.Getenv("CHIRPY_CONFIG")
+	}
+
+	file, fileErr := readConfigFile(*configPath)
+	if fileErr != nil {
+		return c, nil, fileErr
+	}
+	fileValues, valuesErr := settingValues(file.settings)
+	if valuesErr != nil {
+		return c, nil, fmt.Errorf("%s: %w", *configPath, valuesErr)
+	}
+	layers := []configLayer{{*configPath, fileValues}}
+	if c.profile != "" {
+		profile, ok := file.profiles[c.profile]
+		if !ok && *configPath == "" {
+			return c, nil, fmt.Errorf("profile %q needs a config file, set -config or CHIRPY_CONFIG", c.profile)
+		}
+		if !ok {
+			return c, nil, fmt.Errorf("%s has no profile %q", *configPath, c.profile)
+		}
+		profileValues, profileErr := settingValues(profile)
+		if profileErr != nil {
+			return c, nil, fmt.Errorf("%s, profile %q: %w", *configPath, c.profile, profileErr)
+		}
+		layers = append(layers, configLayer{fmt.Sprintf("%s, profile %q", *configPath, c.profile), profileValues})
+	}
+	envValues := map[string]string{}
+	for name, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			envValues[name] = value
+		}
+	}
+	layers = append(layers, configLayer{"environment", envValues})
+
+	configured := map[string]bool{}
+	for _, layer := range layers {
+		for name, value := range layer.values {
+			configured[name] = true
+			if fromCommandLine[name] {
+				continue
+			}
+			if setErr := all.Set(name, value); setErr != nil {
+				if layer.source == "environment" {
+					return c, nil, fmt.Errorf("%s: invalid value %q: %w", settings[name].env, value, setErr)
+				}
+				return c, nil, fmt.Errorf("%s: invalid value %q for %s: %w", layer.source, value, name, setErr)
+			}
+		}
+	}
+	if !fromCommandLine["ephemeral"] && !configured["ephemeral"] {
+		c.ephemeral = c.debug
+	}
+	if c.backupDir == "" {
+		c.backupDir = filepath.Join(c.dataDir, "backups")
+	}
+
+	var keyErr error
+	if c.encryptionKey, keyErr = fsdb.ParseKey(c.keyText); keyErr != nil {
+		return c, nil, keyErr
+	}
+	if validateErr := c.validate(); validateErr != nil {
+		return c, nil, validateErr
+	}
+	return c, commandLine.Args(), nil
+}
+
+// readConfigFile reads the config file at path. An empty path means there is
+// none.
+func readConfigFile(path string) (configFile, error) {
+	var file configFile
+	if path == "" {
+		return file, nil
+	}
+	dat, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return file, readErr
+	}
+	if unmarshalErr := json.Unmarshal(dat, &file.settings); unmarshalErr != nil {
+		return file, fmt.Errorf("%s: %w", path, unmarshalErr)
+	}
+	if rawProfiles, ok := file.settings["profiles"]; ok {
+		delete(file.settings, "profiles")
+		if unmarshalErr := json.Unmarshal(rawProfiles, &file.profiles); unmarshalErr != nil {
+			return file, fmt.Errorf("%s: profiles: %w", path, unmarshalErr)
+		}
+	}
+	return file, nil
+}
+
+// configLayer is one source of settings, keyed by flag name.
+type configLayer struct {
+	source string
+	values map[string]string
+}
+
+// settingValues turns a section of the config file into flag values.
+// Strings, numbers and booleans are accepted, so "port": 8080 works as well
+// as "port": "8080".
+func settingValues(section map[string]json.RawMessage) (map[string]string, error) {
+	values := make(map[string]string, len(section))
+	for name, raw := range section {
+		if _, ok := settings[name]; !ok {
+			return nil, fmt.Errorf("unknown setting %q", name)
+		}
+		var value any
+		decoder := json.NewDecoder(strings.NewReader(string(raw)))
+		decoder.UseNumber()
+		if decodeErr := decoder.Decode(&value); decodeErr != nil {
+			return nil, decodeErr
+		}
+		switch v := value.(type) {
+		case string:
+			values[name] = v
+		case json.Number:
+			values[name] = v.String()
+		case bool:
+			values[name] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("%s must be a string, number or boolean", name)
+		}
+	}
+	return values, nil
+}
+
+func (c config) validate() error {
+	if c.store != "file" && c.store != "memory" {
+		return fmt.Errorf("unknown store %q, expected file or memory", c.store)
+	}
+	if port, atoiErr := strconv.Atoi(c.port); atoiErr != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", c.port)
+	}
+	if c.chirpSegmentSize < 0 {
+		return errors.New("chirp-segment-size can't be negative")
+	}
+	if c.backupsKept < 0 {
+		return errors.New("backups-kept can't be negative")
+	}
+	if c.accessTokenTTL <= 0 || c.refreshTokenTTL <= 0 {
+		return errors.New("token lifetimes must be positive")
+	}
+	if c.ids != "" {
+		if _, strategyErr := fsdb.ParseIdStrategy(c.ids); strategyErr != nil {
+			return strategyErr
+		}
+	}
+	return nil
+}
+
+// validateServer checks the settings only the server needs, so maintenance
+// commands can run without them.
+func (c config) validateServer() error {
+	if c.jwtSecret == "" {
+		return errors.New("JWT_SECRET is empty; refusing to sign tokens with an empty secret")
+	}
+	return nil
+}
+
+// databasePath returns where the database lives: a file, or a directory if it
+// is sharded.
+func (c config) databasePath() string {
+	name := "database"
+	if c.debug {
+		name += ".debug"
+	}
+	if !c.sharded {
+		name += ".json"
+	}
+	return filepath.Join(c.dataDir, name)
+}
+
+func (c config) storeOptions() fsdb.Options {
+	return fsdb.Options{
+		Journal:          c.journal,
+		EncryptionKey:    c.encryptionKey,
+		Sharded:          c.sharded,
+		ChirpSegmentSize: c.chirpSegmentSize,
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fsdb"
+	"net/http"
+)
+
+// storeErrorStatuses maps errors returned by the store to the status code
+// reported to clients. Errors not listed here are internal errors.
+var storeErrorStatuses = []struct {
+	err    error
+	status int
+}{
+	{fsdb.ErrChirpNotFound, 404},
+	{fsdb.ErrUserNotFound, 404},
+	{fsdb.ErrNotChirpAuthor, 403},
+	{fsdb.ErrChirpNotDeleted, 409},
+	{fsdb.ErrParentNotFound, 400},
+	{fsdb.ErrUndeleteExpired, 410},
+	{fsdb.ErrEmailTaken, 409},
+	{fsdb.ErrHandleTaken, 409},
+	{fsdb.ErrInvalidHandle, 400},
+	{fsdb.ErrUnknownEmail, 401},
+	{fsdb.ErrIncorrectPassword, 401},
+	{fsdb.ErrTokenRevoked, 401},
+	{fsdb.ErrBackupNotFound, 404},
+	{fsdb.ErrEmptySearch, 400},
+	{fsdb.ErrUnknownSearchOrder, 400},
+	{fsdb.ErrSearchStatsMismatch, 400},
+}
+
+func statusForStoreError(err error) int {
+	for _, mapping := range storeErrorStatuses {
+		if errors.Is(err, mapping.err) {
+			return mapping.status
+		}
+	}
+	return 500
+}
+
+func respondWithStoreError(w http.ResponseWriter, err error) {
+	respondWithError(w, statusForStoreError(err), err.Error())
+}
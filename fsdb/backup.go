@@ -0,0 +1,243 @@
+package fsdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backupPrefix     = "backup-"
+	backupExtension  = ".json"
+	backupTimeLayout = "20060102-150405.000"
+)
+
+// BackupInfo describes a backup file in a backup directory.
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// WriteSnapshot writes the state seen by the transaction as a database file,
+// which can be opened with Open or loaded with Restore. It is encrypted like
+// the database it comes from.
+func (tx *Tx) WriteSnapshot(w io.Writer) error {
+	dat, encodeErr := encodeDocument(*tx.b.DBStructure)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	sealed, sealErr := tx.sealer.seal(dat, snapshotContext)
+	if sealErr != nil {
+		return sealErr
+	}
+	_, writeErr := w.Write(sealed)
+	return writeErr
+}
+
+// readSnapshot decodes a database file produced by WriteSnapshot or written
+// by DB, migrating it to the current schema version.
+func readSnapshot(r io.Reader, s *sealer) (DBStructure, error) {
+	sealed, readErr := io.ReadAll(r)
+	if readErr != nil {
+		return DBStructure{}, readErr
+	}
+	dat, openErr := s.open(sealed, snapshotContext)
+	if openErr != nil {
+		return DBStructure{}, openErr
+	}
+	dbStructure, _, _, decodeErr := decodeDocument("snapshot", dat, true)
+	if decodeErr != nil {
+		return DBStructure{}, decodeErr
+	}
+	dbStructure.fillDefaults()
+	return dbStructure, nil
+}
+
+// Restore replaces the entire content of the database with the snapshot
+// read from r. The database is left unchanged if the snapshot can't be read
+// or written.
+func (db *DB) Restore(r io.Reader) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	restored, readErr := readSnapshot(r, db.sealer)
+	if readErr != nil {
+		return readErr
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	reset := db.feed.prepareReset(&restored)
+	previous := db.dbStructure
+	db.dbStructure = restored
+	var persistErr error
+	if db.journal != nil {
+		db.unsaved = nil
+		persistErr = db.compact()
+	} else {
+		persistErr = db.writeDB(db.dbStructure, nil)
+	}
+	if persistErr != nil {
+		db.dbStructure = previous
+		return persistErr
+	}
+	db.feed.publish([]Change{reset})
+	return nil
+}
+
+func (db *MemDB) Restore(r io.Reader) error {
+	restored, readErr := readSnapshot(r, nil)
+	if readErr != nil {
+		return readErr
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	reset := db.feed.prepareReset(&restored)
+	db.dbStructure = restored
+	db.feed.publish([]Change{reset})
+	return nil
+}
+
+// WriteBackup writes a point-in-time snapshot of store into dir and then
+// deletes the oldest backups so that at most keep remain. A keep of zero or
+// less disables rotation.
+func WriteBackup(store Store, dir string, keep int) (BackupInfo, error) {
+	if mkdirErr := os.MkdirAll(dir, 0700); mkdirErr != nil {
+		return BackupInfo{}, mkdirErr
+	}
+	createdAt := time.Now().UTC()
+	var snapshot bytes.Buffer
+	viewErr := store.View(func(tx *Tx) error {
+		return tx.WriteSnapshot(&snapshot)
+	})
+	if viewErr != nil {
+		return BackupInfo{}, viewErr
+	}
+	name, reserveErr := reserveBackupName(dir, createdAt)
+	if reserveErr != nil {
+		return BackupInfo{}, reserveErr
+	}
+	if writeErr := atomicWriteFile(filepath.Join(dir, name), snapshot.Bytes(), false); writeErr != nil {
+		os.Remove(filepath.Join(dir, name))
+		return BackupInfo{}, writeErr
+	}
+	info := BackupInfo{Name: name, CreatedAt: createdAt, Size: int64(snapshot.Len())}
+	if keep <= 0 {
+		return info, nil
+	}
+	backups, listErr := ListBackups(dir)
+	if listErr != nil {
+		return info, listErr
+	}
+	for _, old := range backups[min(keep, len(backups)):] {
+		if removeErr := os.Remove(filepath.Join(dir, old.Name)); removeErr != nil {
+			return info, removeErr
+		}
+	}
+	return info, nil
+}
+
+// reserveBackupName claims a name for a backup created at createdAt by
+// creating an empty file under it, which the backup then replaces. Backups
+// created in the same millisecond are told apart by a counter, as in
+// backup-20240102-030405.678-2.json.
+func reserveBackupName(dir string, createdAt time.Time) (string, error) {
+	stamp := backupPrefix + createdAt.Format(backupTimeLayout)
+	for n := 1; ; n++ {
+		name := stamp + backupExtension
+		if n > 1 {
+			name = fmt.Sprintf("%s-%d%s", stamp, n, backupExtension)
+		}
+		file, createErr := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(createErr, os.ErrExist) {
+			continue
+		}
+		if createErr != nil {
+			return "", createErr
+		}
+		return name, file.Close()
+	}
+}
+
+// parseBackupName returns the time a backup was created at from its name, and
+// the counter telling backups of the same millisecond apart.
+func parseBackupName(name string) (time.Time, int, bool) {
+	if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupExtension) {
+		return time.Time{}, 0, false
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupExtension)
+	if len(stamp) < len(backupTimeLayout) {
+		return time.Time{}, 0, false
+	}
+	createdAt, parseErr := time.Parse(backupTimeLayout, stamp[:len(backupTimeLayout)])
+	if parseErr != nil {
+		return time.Time{}, 0, false
+	}
+	rest := stamp[len(backupTimeLayout):]
+	if rest == "" {
+		return createdAt, 1, true
+	}
+	digits, hasDash := strings.CutPrefix(rest, "-")
+	counter, atoiErr := strconv.Atoi(digits)
+	if !hasDash || atoiErr != nil || counter < 2 {
+		return time.Time{}, 0, false
+	}
+	return createdAt, counter, true
+}
+
+// ListBackups returns the backups in dir, newest first. A missing directory
+// holds no backups.
+func ListBackups(dir string) ([]BackupInfo, error) {
+	entries, readErr := os.ReadDir(dir)
+	if errors.Is(readErr, os.ErrNotExist) {
+		return []BackupInfo{}, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	backups := []BackupInfo{}
+	counters := map[string]int{}
+	for _, entry := range entries {
+		name := entry.Name()
+		createdAt, counter, ok := parseBackupName(name)
+		if entry.IsDir() || !ok {
+			continue
+		}
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			return nil, infoErr
+		}
+		backups = append(backups, BackupInfo{Name: name, CreatedAt: createdAt, Size: info.Size()})
+		counters[name] = counter
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].CreatedAt.Equal(backups[j].CreatedAt) {
+			return backups[i].CreatedAt.After(backups[j].CreatedAt)
+		}
+		return counters[backups[i].Name] > counters[backups[j].Name]
+	})
+	return backups, nil
+}
+
+// RestoreBackup loads the backup called name from dir into store.
+func RestoreBackup(store Store, dir, name string) error {
+	if name != filepath.Base(name) || !strings.HasPrefix(name, backupPrefix) {
+		return fmt.Errorf("%w: %s", ErrBackupNotFound, name)
+	}
+	file, openErr := os.Open(filepath.Join(dir, name))
+	if errors.Is(openErr, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrBackupNotFound, name)
+	}
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	return store.Restore(file)
+}
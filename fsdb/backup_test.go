@@ -0,0 +1,53 @@
+package fsdb
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBackupsOfTheSameMillisecondGetTheirOwnNames(t *testing.T) {
+	dir := t.TempDir()
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 678_000_000, time.UTC)
+	names := []string{}
+	for i := 0; i < 11; i++ {
+		name, reserveErr := reserveBackupName(dir, createdAt)
+		if reserveErr != nil {
+			t.Fatal(reserveErr)
+		}
+		names = append(names, name)
+	}
+	if names[0] != "backup-20240102-030405.678.json" || names[1] != "backup-20240102-030405.678-2.json" {
+		t.Errorf("got names %v", names[:2])
+	}
+
+	backups, listErr := ListBackups(dir)
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	listed := []string{}
+	for _, backup := range backups {
+		listed = append(listed, backup.Name)
+	}
+	slices.Reverse(names)
+	if !slices.Equal(listed, names) {
+		t.Errorf("got %v, want the newest first: %v", listed, names)
+	}
+}
+
+func TestWriteBackupKeepsEveryBackupUpToTheLimit(t *testing.T) {
+	dir := t.TempDir()
+	db := NewMemDB()
+	for i := 0; i < 5; i++ {
+		if _, backupErr := WriteBackup(db, dir, 3); backupErr != nil {
+			t.Fatal(backupErr)
+		}
+		backups, listErr := ListBackups(dir)
+		if listErr != nil {
+			t.Fatal(listErr)
+		}
+		if want := min(i+1, 3); len(backups) != want {
+			t.Fatalf("after %d backups: got %d, want %d", i+1, len(backups), want)
+		}
+	}
+}
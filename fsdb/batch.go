@@ -0,0 +1,165 @@
+package fsdb
+
+import "time"
+
+type recordOp string
+
+const (
+	opChirpCreated     recordOp = "chirp.created"
+	opChirpSoftDeleted recordOp = "chirp.soft_deleted"
+	opChirpUndeleted   recordOp = "chirp.undeleted"
+	opChirpDeleted     recordOp = "chirp.deleted"
+	opChirpLiked       recordOp = "chirp.liked"
+	opChirpUnliked     recordOp = "chirp.unliked"
+	opUserCreated      recordOp = "user.created"
+	opUserUpdated      recordOp = "user.updated"
+	opUserUpgraded     recordOp = "user.upgraded"
+	opUserDeleted      recordOp = "user.deleted"
+	opTokenRevoked     recordOp = "token.revoked"
+	opTokenExpired     recordOp = "token.expired"
+	opMetadataSet      recordOp = "metadata.set"
+)
+
+// record describes a single mutation of a DBStructure. Records carry the
+// full state of the entity after the change, so applying one is idempotent.
+type record struct {
+	Op        recordOp   `json:"op"`
+	Chirp     *Chirp     `json:"chirp,omitempty"`
+	User      *DBUser    `json:"user,omitempty"`
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Key       string     `json:"key,omitempty"`
+	Value     string     `json:"value,omitempty"`
+	Like      *Like      `json:"like,omitempty"`
+}
+
+func (dbStructure *DBStructure) apply(rec record) {
+	switch rec.Op {
+	case opChirpCreated, opChirpSoftDeleted, opChirpUndeleted:
+		dbStructure.setChirp(*rec.Chirp)
+	case opChirpDeleted:
+		dbStructure.removeChirp(rec.Chirp.Id)
+	case opChirpLiked:
+		dbStructure.setLike(*rec.Like)
+	case opChirpUnliked:
+		dbStructure.removeLike(rec.Like.ChirpId, rec.Like.UserId)
+	case opUserCreated, opUserUpdated, opUserUpgraded:
+		dbStructure.setUser(*rec.User)
+	case opUserDeleted:
+		dbStructure.removeUser(rec.User.Id)
+	case opTokenRevoked:
+		if rec.ExpiresAt != nil {
+			dbStructure.RevokedTokens[rec.Token] = *rec.ExpiresAt
+		}
+	case opTokenExpired:
+		delete(dbStructure.RevokedTokens, rec.Token)
+	case opMetadataSet:
+		dbStructure.Metadata[rec.Key] = rec.Value
+	}
+}
+
+// batch collects the mutations made by one write operation. Every change is
+// applied to the structure immediately so later reads in the same operation
+// see it, and can be undone with rollback if the operation fails or cannot
+// be persisted. Every change made by the batch is stamped with the same time,
+// now.
+type batch struct {
+	*DBStructure
+	records []record
+	undo    []func()
+	now     time.Time
+}
+
+func newBatch(dbStructure *DBStructure) *batch {
+	return &batch{DBStructure: dbStructure, now: time.Now().UTC()}
+}
+
+func (b *batch) record(rec record) {
+	switch rec.Op {
+	case opChirpCreated, opChirpSoftDeleted, opChirpUndeleted, opChirpDeleted:
+		id := rec.Chirp.Id
+		prev, existed := b.Chirps[id]
+		b.undo = append(b.undo, func() {
+			if existed {
+				b.setChirp(prev)
+			} else {
+				b.removeChirp(id)
+			}
+		})
+	case opChirpLiked, opChirpUnliked:
+		like := *rec.Like
+		prev, existed := b.Likes[like.ChirpId][like.UserId]
+		b.undo = append(b.undo, func() {
+			if existed {
+				b.setLike(Like{ChirpId: like.ChirpId, UserId: like.UserId, LikedAt: prev})
+			} else {
+				b.removeLike(like.ChirpId, like.UserId)
+			}
+		})
+	case opUserCreated, opUserUpdated, opUserUpgraded, opUserDeleted:
+		id := rec.User.Id
+		prev, existed := b.Users[id]
+		b.undo = append(b.undo, func() {
+			if existed {
+				b.setUser(prev)
+			} else {
+				b.removeUser(id)
+			}
+		})
+	case opTokenRevoked, opTokenExpired:
+		token := rec.Token
+		prev, existed := b.RevokedTokens[token]
+		b.undo = append(b.undo, func() {
+			if existed {
+				b.RevokedTokens[token] = prev
+			} else {
+				delete(b.RevokedTokens, token)
+			}
+		})
+	case opMetadataSet:
+		key := rec.Key
+		prev, existed := b.Metadata[key]
+		b.undo = append(b.undo, func() {
+			if existed {
+				b.Metadata[key] = prev
+			} else {
+				delete(b.Metadata, key)
+			}
+		})
+	}
+	b.apply(rec)
+	b.records = append(b.records, rec)
+}
+
+// rollback reverts every change recorded so far, newest first.
+func (b *batch) rollback() {
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		b.undo[i]()
+	}
+	b.undo = nil
+	b.records = nil
+}
+
+func (b *batch) putChirp(op recordOp, chirp Chirp) {
+	b.record(record{Op: op, Chirp: &chirp})
+}
+
+func (b *batch) putLike(op recordOp, like Like) {
+	b.record(record{Op: op, Like: &like})
+}
+
+func (b *batch) putUser(op recordOp, user DBUser) {
+	b.record(record{Op: op, User: &user})
+}
+
+func (b *batch) putRevokedToken(tokenKey string, expiresAt time.Time) {
+	b.record(record{Op: opTokenRevoked, Token: tokenKey, ExpiresAt: &expiresAt})
+}
+
+func (b *batch) removeRevokedToken(tokenKey string) {
+	b.record(record{Op: opTokenExpired, Token: tokenKey})
+}
+
+func (b *batch) setMetadata(key, value string) {
+	b.record(record{Op: opMetadataSet, Key: key, Value: value})
+}
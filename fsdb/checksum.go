@@ -0,0 +1,78 @@
+package fsdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+)
+
+// checksumKey is the metadata key holding a hash of the rest of the document.
+// It covers the decoded data rather than the raw bytes, so reformatting a file
+// doesn't invalidate it, but any change to a value does.
+const checksumKey = "checksum"
+
+const checksumPrefix = "sha256:"
+
+func computeChecksum(dbStructure DBStructure) (string, error) {
+	metadata := maps.Clone(dbStructure.Metadata)
+	delete(metadata, checksumKey)
+	dbStructure.Metadata = metadata
+	dat, marshalErr := json.Marshal(dbStructure)
+	if marshalErr != nil {
+		return "", marshalErr
+	}
+	sum := sha256.Sum256(dat)
+	return checksumPrefix + hex.EncodeToString(sum[:]), nil
+}
+
+// encodeDocument serializes dbStructure for writing to disk, stamping it with
+// a fresh checksum. The structure itself is left unchanged.
+func encodeDocument(dbStructure DBStructure) ([]byte, error) {
+	sum, sumErr := computeChecksum(dbStructure)
+	if sumErr != nil {
+		return nil, sumErr
+	}
+	metadata := maps.Clone(dbStructure.Metadata)
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata[checksumKey] = sum
+	dbStructure.Metadata = metadata
+	return json.Marshal(dbStructure)
+}
+
+// verifyChecksum checks a decoded document against its stored checksum.
+// Documents without one, such as files written before checksums were
+// introduced, pass.
+func verifyChecksum(path string, dbStructure DBStructure) error {
+	stored, ok := dbStructure.Metadata[checksumKey]
+	if !ok {
+		return nil
+	}
+	computed, sumErr := computeChecksum(dbStructure)
+	if sumErr != nil {
+		return sumErr
+	}
+	if computed != stored {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, path)
+	}
+	return nil
+}
+
+// VerifyChecksum reads the database file at path, or every file of a sharded
+// database, and checks it against its stored checksum without opening the
+// database. key is needed to read an encrypted file.
+func VerifyChecksum(path string, key []byte) error {
+	s, sealerErr := newSealer(key)
+	if sealerErr != nil {
+		return sealerErr
+	}
+	if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+		return (&shardLayout{dir: path}).verifyChecksums(s)
+	}
+	_, _, loadErr := readDBFile(path, s, true)
+	return loadErr
+}
@@ -0,0 +1,422 @@
+package fsdb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeySize is the length of an encryption key in bytes.
+const KeySize = 32
+
+const encryptionAlgorithm = "aes-256-gcm"
+
+// envelope is how encrypted data is stored: every database file and every
+// journal line is replaced by one. KeyId identifies the key without
+// revealing it, so a wrong key can be told apart from damaged data. Context
+// names what the data is, such as a shard, and is authenticated along with
+// it, so an envelope moved to another file doesn't decrypt. Envelopes
+// written before contexts existed have none.
+type envelope struct {
+	Encryption string `json:"encryption"`
+	KeyId      string `json:"key_id"`
+	Context    string `json:"context,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// Contexts of encrypted data. A whole document, which is what a single-file
+// database, its copies and backups hold, is a snapshot; each file of a
+// sharded database has the context of its shardContext. Contexts don't tell
+// versions of the same file apart.
+const (
+	snapshotContext = "snapshot"
+	journalContext  = "journal"
+)
+
+// shardContext returns the context of the file of a sharded database at
+// path, which its backups and the copies kept of it share.
+func shardContext(path string) string {
+	name := filepath.Base(path)
+	if end := strings.Index(name, shardExtension); end >= 0 {
+		name = name[:end+len(shardExtension)]
+	}
+	return "shard " + name
+}
+
+// envelopePrefix starts every encoded envelope, as the encryption field is
+// marshaled first.
+var envelopePrefix = []byte(`{"encryption":`)
+
+// sealer encrypts and decrypts data with one key. A nil sealer stands for
+// no encryption.
+type sealer struct {
+	aead  cipher.AEAD
+	keyId string
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	if key == nil {
+		return nil, nil
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, cipherErr := aes.NewCipher(key)
+	if cipherErr != nil {
+		return nil, cipherErr
+	}
+	aead, gcmErr := cipher.NewGCM(block)
+	if gcmErr != nil {
+		return nil, gcmErr
+	}
+	return &sealer{aead: aead, keyId: keyId(key)}, nil
+}
+
+func keyId(key []byte) string {
+	sum := sha256.Sum256(append([]byte("fsdb key id\x00"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// seal encrypts plaintext into an envelope bound to context, or returns it as
+// is if s is nil.
+func (s *sealer) seal(plaintext []byte, context string) ([]byte, error) {
+	if s == nil {
+		return plaintext, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, randErr := rand.Read(nonce); randErr != nil {
+		return nil, randErr
+	}
+	return json.Marshal(envelope{
+		Encryption: encryptionAlgorithm,
+		KeyId:      s.keyId,
+		Context:    context,
+		Nonce:      nonce,
+		Data:       s.aead.Seal(nil, nonce, plaintext, []byte(context)),
+	})
+}
+
+func isSealed(dat []byte) bool {
+	return bytes.HasPrefix(dat, envelopePrefix)
+}
+
+// id returns the id of the key, or an empty string for no encryption.
+func (s *sealer) id() string {
+	if s == nil {
+		return ""
+	}
+	return s.keyId
+}
+
+// sealedWith returns the id of the key dat was encrypted with, or an empty
+// string if it isn't encrypted.
+func sealedWith(dat []byte) string {
+	if !isSealed(dat) {
+		return ""
+	}
+	env := envelope{}
+	json.Unmarshal(dat, &env)
+	return env.KeyId
+}
+
+// isBound tells whether dat is encrypted with a context.
+func isBound(dat []byte) bool {
+	if !isSealed(dat) {
+		return false
+	}
+	env := envelope{}
+	json.Unmarshal(dat, &env)
+	return env.Context != ""
+}
+
+// open decrypts an envelope written by seal for context. Data that isn't
+// encrypted is returned as is, so files written before encryption was
+// enabled stay readable, and so are envelopes without a context.
+func (s *sealer) open(dat []byte, context string) ([]byte, error) {
+	if !isSealed(dat) {
+		return dat, nil
+	}
+	env := envelope{}
+	if unmarshalErr := json.Unmarshal(dat, &env); unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	if env.Encryption != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption %q", env.Encryption)
+	}
+	if s == nil {
+		return nil, ErrEncrypted
+	}
+	if env.KeyId != s.keyId {
+		return nil, ErrWrongKey
+	}
+	if env.Context != "" && env.Context != context {
+		return nil, fmt.Errorf("data was encrypted as %s, not %s", env.Context, context)
+	}
+	plaintext, openErr := s.aead.Open(nil, env.Nonce, env.Data, []byte(env.Context))
+	if openErr != nil {
+		return nil, fmt.Errorf("decryption failed: %w", openErr)
+	}
+	return plaintext, nil
+}
+
+// ParseKey decodes a base64 encoded encryption key as produced by
+// GenerateKey. An empty string means no encryption and yields a nil key.
+func ParseKey(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	key, decodeErr := base64.StdEncoding.DecodeString(encoded)
+	if decodeErr != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", decodeErr)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid encryption key: must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// GenerateKey returns a new random encryption key, base64 encoded.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, randErr := rand.Read(key); randErr != nil {
+		return "", randErr
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// RotateKey re-encrypts the database with newKey, or stores it unencrypted
+// if newKey is nil. The snapshot and its backup are rewritten and the journal
+// is folded into them, and the copies kept by recovery and migrations are
+// re-encrypted, so no file of the database is left under the old key. Copies
+// too damaged to decrypt are removed.
+func (db *DB) RotateKey(newKey []byte) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	s, sealerErr := newSealer(newKey)
+	if sealerErr != nil {
+		return sealerErr
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	oldSealer, oldKey := db.sealer, db.options.EncryptionKey
+	db.setSealer(s, newKey)
+	if rewriteErr := db.rewrite(); rewriteErr != nil {
+		db.setSealer(oldSealer, oldKey)
+		return rewriteErr
+	}
+	return db.resealCopies(oldSealer)
+}
+
+func (db *DB) setSealer(s *sealer, key []byte) {
+	db.sealer = s
+	db.options.EncryptionKey = key
+	if db.journal != nil {
+		db.journal.sealer = s
+	}
+}
+
+// sealPlaintextFiles encrypts a database that was written without
+// encryption, which is how encryption is enabled for existing data, or
+// before envelopes had contexts. Backups and the copies kept by recovery and
+// migrations are encrypted too, as a migration on open leaves them in
+// plaintext even if the snapshot isn't.
+func (db *DB) sealPlaintextFiles() error {
+	paths, listErr := db.files()
+	if listErr != nil {
+		return listErr
+	}
+	for _, path := range paths {
+		sealed := true
+		for _, file := range []string{path, path + backupSuffix} {
+			dat, readErr := os.ReadFile(file)
+			if errors.Is(readErr, os.ErrNotExist) {
+				continue
+			}
+			if readErr != nil {
+				return readErr
+			}
+			sealed = sealed && isBound(dat)
+		}
+		if !sealed {
+			if rewriteErr := db.rewrite(); rewriteErr != nil {
+				return rewriteErr
+			}
+			break
+		}
+	}
+	return db.resealCopies(nil)
+}
+
+// copies lists the files recovery and migrations kept of the database:
+// damaged files set aside, and snapshots from before each migration, which
+// are directories for a sharded database.
+func (db *DB) copies() ([]string, error) {
+	patterns := []string{db.Path + corruptSuffix + "*", db.Path + preMigrationInfix + "*"}
+	if db.shards != nil {
+		patterns = append(patterns, filepath.Join(db.Path, "*"+corruptSuffix+"*"))
+	}
+	paths := []string{}
+	for _, pattern := range patterns {
+		matches, globErr := filepath.Glob(pattern)
+		if globErr != nil {
+			return nil, globErr
+		}
+		for _, match := range matches {
+			info, statErr := os.Stat(match)
+			if statErr != nil {
+				return nil, statErr
+			}
+			if !info.IsDir() {
+				paths = append(paths, match)
+				continue
+			}
+			entries, readErr := os.ReadDir(match)
+			if readErr != nil {
+				return nil, readErr
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					paths = append(paths, filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+	return paths, nil
+}
+
+// resealCopies encrypts the copies of the database with the current key and
+// their context. With from set, copies encrypted with it are decrypted first
+// and those that can't be are removed, as they would stay readable with a
+// retired key. Without it, only plaintext copies and those encrypted with the
+// current key but without a context are resealed.
+func (db *DB) resealCopies(from *sealer) error {
+	paths, listErr := db.copies()
+	if listErr != nil {
+		return listErr
+	}
+	for _, path := range paths {
+		dat, readErr := os.ReadFile(path)
+		if readErr != nil {
+			return readErr
+		}
+		context := snapshotContext
+		if db.shards != nil {
+			context = shardContext(path)
+		}
+		opener := from
+		switch sealedWith(dat) {
+		case db.sealer.id():
+			if db.sealer == nil || isBound(dat) {
+				continue
+			}
+			opener = db.sealer
+		case "":
+		default:
+			if from == nil {
+				continue
+			}
+		}
+		plaintext, openErr := opener.open(dat, context)
+		if openErr != nil && opener == from {
+			if removeErr := os.Remove(path); removeErr != nil {
+				return removeErr
+			}
+			continue
+		}
+		if openErr != nil {
+			// A copy set aside as damaged may well not decrypt; it is kept
+			// for inspection under the key it has.
+			continue
+		}
+		sealed, sealErr := db.sealer.seal(plaintext, context)
+		if sealErr != nil {
+			return sealErr
+		}
+		if writeErr := atomicWriteFile(path, sealed, false); writeErr != nil {
+			return writeErr
+		}
+	}
+	return nil
+}
+
+// rewrite writes the current state as a fresh snapshot, folding in the
+// journal, and makes the backup a copy of it, so no file is left in an older
+// format. The caller must hold the write lock.
+func (db *DB) rewrite() error {
+	var writeErr error
+	if db.journal != nil {
+		db.unsaved = nil
+		writeErr = db.compact()
+	} else {
+		writeErr = db.writeDB(db.dbStructure, nil)
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	paths, listErr := db.files()
+	if listErr != nil {
+		return listErr
+	}
+	for _, path := range paths {
+		if backupErr := backupFile(path); backupErr != nil {
+			return backupErr
+		}
+	}
+	return nil
+}
+
+// RekeyBackups re-encrypts every backup in dir from oldKey to newKey. Either
+// key may be nil for unencrypted backups. Backups already encrypted with
+// newKey are left alone.
+func RekeyBackups(dir string, oldKey, newKey []byte) error {
+	from, fromErr := newSealer(oldKey)
+	if fromErr != nil {
+		return fromErr
+	}
+	to, toErr := newSealer(newKey)
+	if toErr != nil {
+		return toErr
+	}
+	backups, listErr := ListBackups(dir)
+	if listErr != nil {
+		return listErr
+	}
+	for _, backup := range backups {
+		path := filepath.Join(dir, backup.Name)
+		dat, readErr := os.ReadFile(path)
+		if readErr != nil {
+			return readErr
+		}
+		opener := from
+		if sealedWith(dat) == to.id() {
+			if to == nil || isBound(dat) {
+				continue
+			}
+			opener = to
+		}
+		plaintext, openErr := opener.open(dat, snapshotContext)
+		if openErr != nil {
+			return fmt.Errorf("%s: %w", backup.Name, openErr)
+		}
+		sealed, sealErr := to.seal(plaintext, snapshotContext)
+		if sealErr != nil {
+			return sealErr
+		}
+		if writeErr := atomicWriteFile(path, sealed, false); writeErr != nil {
+			return writeErr
+		}
+	}
+	return nil
+}
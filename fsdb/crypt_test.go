@@ -0,0 +1,192 @@
+package fsdb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, KeySize)
+	if _, randErr := rand.Read(key); randErr != nil {
+		t.Fatal(randErr)
+	}
+	return key
+}
+
+func TestSealedDataOnlyOpensInItsContext(t *testing.T) {
+	s, sealerErr := newSealer(newKey(t))
+	if sealerErr != nil {
+		t.Fatal(sealerErr)
+	}
+	sealed, sealErr := s.seal([]byte(`{"chirps":{}}`), shardContext("chirps-00000001.json"))
+	if sealErr != nil {
+		t.Fatal(sealErr)
+	}
+	if _, openErr := s.open(sealed, shardContext("/db/chirps-00000001.json.bak")); openErr != nil {
+		t.Errorf("opening the backup of the shard: %v", openErr)
+	}
+	if _, openErr := s.open(sealed, shardContext("chirps-00000002.json")); openErr == nil {
+		t.Error("opened a shard as another one")
+	}
+
+	// Claiming another context doesn't help, as it is authenticated.
+	env := envelope{}
+	if unmarshalErr := json.Unmarshal(sealed, &env); unmarshalErr != nil {
+		t.Fatal(unmarshalErr)
+	}
+	env.Context = shardContext("chirps-00000002.json")
+	relabeled, _ := json.Marshal(env)
+	if _, openErr := s.open(relabeled, env.Context); openErr == nil {
+		t.Error("opened a shard whose context was rewritten")
+	}
+}
+
+func TestSwappedShardsFailVerification(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database")
+	key := newKey(t)
+	db, openErr := Open(path, Options{EncryptionKey: key, Sharded: true, ChirpSegmentSize: 1})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	user, createErr := db.CreateUser("a@x.com", "x", "")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	for _, body := range []string{"first", "second"} {
+		if _, chirpErr := db.CreateChirp(body, user.Id); chirpErr != nil {
+			t.Fatal(chirpErr)
+		}
+	}
+	if closeErr := db.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	if verifyErr := VerifyChecksum(path, key); verifyErr != nil {
+		t.Fatal(verifyErr)
+	}
+
+	first, second := filepath.Join(path, "chirps-00000001.json"), filepath.Join(path, "chirps-00000002.json")
+	firstDat, _ := os.ReadFile(first)
+	secondDat, _ := os.ReadFile(second)
+	os.WriteFile(first, secondDat, 0o666)
+	os.WriteFile(second, firstDat, 0o666)
+	if verifyErr := VerifyChecksum(path, key); verifyErr == nil {
+		t.Error("swapped chirp segments passed verification")
+	}
+}
+
+func TestOpenBindsEnvelopesWithoutContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	key := newKey(t)
+	s, sealerErr := newSealer(key)
+	if sealerErr != nil {
+		t.Fatal(sealerErr)
+	}
+	dat, encodeErr := encodeDocument(newDBStructure())
+	if encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+	// An envelope as written before contexts existed.
+	nonce := make([]byte, s.aead.NonceSize())
+	legacy, _ := json.Marshal(envelope{Encryption: encryptionAlgorithm, KeyId: s.keyId, Nonce: nonce, Data: s.aead.Seal(nil, nonce, dat, nil)})
+	if writeErr := os.WriteFile(path, legacy, 0o666); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	db, openErr := Open(path, Options{EncryptionKey: key})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	db.Close()
+	for _, file := range []string{path, path + backupSuffix} {
+		if dat, _ := os.ReadFile(file); !isBound(dat) {
+			t.Errorf("%s wasn't resealed with a context", filepath.Base(file))
+		}
+	}
+}
+
+// encryptedDB creates a database at path encrypted with key, holding one
+// user.
+func encryptedDB(t *testing.T, path string, key []byte) *DB {
+	t.Helper()
+	db, openErr := Open(path, Options{EncryptionKey: key})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	if _, createErr := db.CreateUser("a@x.com", "x", ""); createErr != nil {
+		t.Fatal(createErr)
+	}
+	return db
+}
+
+func TestOpenWithWrongKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	encryptedDB(t, path, newKey(t)).Close()
+	before, _ := os.ReadFile(path)
+
+	if _, openErr := Open(path, Options{EncryptionKey: newKey(t)}); !errors.Is(openErr, ErrWrongKey) {
+		t.Errorf("another key: got %v, want ErrWrongKey", openErr)
+	}
+	if _, openErr := Open(path, Options{}); !errors.Is(openErr, ErrEncrypted) {
+		t.Errorf("no key: got %v, want ErrEncrypted", openErr)
+	}
+	// A wrong key isn't damage: nothing is restored or set aside.
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, before) {
+		t.Error("database file changed")
+	}
+	if corrupt, _ := filepath.Glob(path + corruptSuffix + "*"); len(corrupt) > 0 {
+		t.Errorf("database was set aside as %v", corrupt)
+	}
+}
+
+func TestRotateKeyAndRekeyBackups(t *testing.T) {
+	dir := t.TempDir()
+	path, backupDir := filepath.Join(dir, "database.json"), filepath.Join(dir, "backups")
+	oldKey, rotatedKey := newKey(t), newKey(t)
+	db := encryptedDB(t, path, oldKey)
+	backup, backupErr := WriteBackup(db, backupDir, 0)
+	if backupErr != nil {
+		t.Fatal(backupErr)
+	}
+	if rotateErr := db.RotateKey(rotatedKey); rotateErr != nil {
+		t.Fatal(rotateErr)
+	}
+	db.Close()
+	if rekeyErr := RekeyBackups(backupDir, oldKey, rotatedKey); rekeyErr != nil {
+		t.Fatal(rekeyErr)
+	}
+
+	s, _ := newSealer(rotatedKey)
+	for _, file := range []string{path, path + backupSuffix, filepath.Join(backupDir, backup.Name)} {
+		if dat, _ := os.ReadFile(file); sealedWith(dat) != s.id() {
+			t.Errorf("%s isn't encrypted with the new key", filepath.Base(file))
+		}
+	}
+	if _, openErr := Open(path, Options{EncryptionKey: oldKey}); !errors.Is(openErr, ErrWrongKey) {
+		t.Errorf("old key: got %v, want ErrWrongKey", openErr)
+	}
+	db, openErr := Open(path, Options{EncryptionKey: rotatedKey})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	if restoreErr := RestoreBackup(db, backupDir, backup.Name); restoreErr != nil {
+		t.Fatalf("restoring the rekeyed backup: %v", restoreErr)
+	}
+	if _, getErr := db.GetUser("1"); getErr != nil {
+		t.Errorf("user after restore: %v", getErr)
+	}
+
+	// Rekeying to no key leaves the backups in plaintext.
+	if rekeyErr := RekeyBackups(backupDir, rotatedKey, nil); rekeyErr != nil {
+		t.Fatal(rekeyErr)
+	}
+	if dat, _ := os.ReadFile(filepath.Join(backupDir, backup.Name)); isSealed(dat) {
+		t.Error("backup is still encrypted")
+	}
+}
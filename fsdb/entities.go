@@ -0,0 +1,103 @@
+package fsdb
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Hashtag is a #tag in a chirp body. Start and End are the offsets, counted
+// in characters, of the tag and its # sign; Tag is the tag in lower case and
+// without the #.
+type Hashtag struct {
+	Tag   string `json:"tag"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// Mention is an @handle in a chirp body that names the user with that
+// handle; see User.Handle. Start and End are offsets like those of Hashtag.
+type Mention struct {
+	UserId string `json:"user_id"`
+	Handle string `json:"handle"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+}
+
+// maxHandleLength is the most characters a handle may have.
+const maxHandleLength = 30
+
+// normalizeHandle turns "@Bob" into the form handles are stored under,
+// "bob", and checks that parseEntities would read the handle whole.
+func normalizeHandle(handle string) (string, error) {
+	handle = strings.ToLower(strings.TrimPrefix(handle, "@"))
+	runes := []rune(handle)
+	if len(runes) == 0 || len(runes) > maxHandleLength || !isWordRune(runes[len(runes)-1]) {
+		return "", ErrInvalidHandle
+	}
+	for _, r := range runes {
+		if !isWordRune(r) && r != '.' && r != '-' {
+			return "", ErrInvalidHandle
+		}
+	}
+	return handle, nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// parseEntities finds the hashtags and mentions in body. A # or @ only starts
+// one at the beginning of a word, so neither "C#" nor "a@b.c" count. Tags
+// consist of letters, digits and underscores and can't be just a number;
+// handles can also contain dots and dashes, except at the end. resolve
+// returns the id of the user with a handle, if there is one.
+func parseEntities(body string, resolve func(handle string) (string, bool)) ([]Hashtag, []Mention) {
+	var hashtags []Hashtag
+	var mentions []Mention
+	runes := []rune(body)
+	for start := 0; start < len(runes); start++ {
+		sign := runes[start]
+		if (sign != '#' && sign != '@') || (start > 0 && isWordRune(runes[start-1])) {
+			continue
+		}
+		end := start + 1
+		for end < len(runes) && (isWordRune(runes[end]) || (sign == '@' && (runes[end] == '.' || runes[end] == '-'))) {
+			end++
+		}
+		for end > start+1 && (runes[end-1] == '.' || runes[end-1] == '-') {
+			end--
+		}
+		name := strings.ToLower(string(runes[start+1 : end]))
+		switch {
+		case name == "":
+			continue
+		case sign == '#':
+			if strings.TrimFunc(name, unicode.IsDigit) != "" {
+				hashtags = append(hashtags, Hashtag{Tag: name, Start: start, End: end})
+			}
+		default:
+			if userId, ok := resolve(name); ok {
+				mentions = append(mentions, Mention{UserId: userId, Handle: name, Start: start, End: end})
+			}
+		}
+		start = end - 1
+	}
+	return hashtags, mentions
+}
+
+// resolveHandle returns the id of the user with handle.
+func (dbStructure *DBStructure) resolveHandle(handle string) (string, bool) {
+	userId, ok := dbStructure.indexes.userIdByHandle[handle]
+	return userId, ok
+}
+
+// extractEntities fills in the hashtags and mentions of a chirp from its
+// body, resolving mentions against the current users.
+func (dbStructure *DBStructure) extractEntities(chirp *Chirp) {
+	chirp.Hashtags, chirp.Mentions = parseEntities(chirp.Body, dbStructure.resolveHandle)
+}
+
+// normalizeHashtag turns "#Go" into the form hashtags are indexed under, "go".
+func normalizeHashtag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
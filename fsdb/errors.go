@@ -0,0 +1,34 @@
+package fsdb
+
+import "errors"
+
+// Errors returned by Store and Tx methods. Callers should compare against
+// them with errors.Is, as they may be wrapped with additional context.
+var (
+	ErrChirpNotFound       = errors.New("Chirp does not exist")
+	ErrNotChirpAuthor      = errors.New("Chirp belongs to another user")
+	ErrChirpNotDeleted     = errors.New("Chirp isn't deleted")
+	ErrParentNotFound      = errors.New("Chirp to reply to does not exist")
+	ErrUndeleteExpired     = errors.New("Chirp was deleted too long ago to be restored")
+	ErrUserNotFound        = errors.New("User doesn't exist")
+	ErrEmailTaken          = errors.New("Email already in use")
+	ErrHandleTaken         = errors.New("Handle already in use")
+	ErrInvalidHandle       = errors.New("Handle must be up to 30 letters, digits, underscores, dots or dashes and can't end in a dot or dash")
+	ErrUnknownEmail        = errors.New("No user with that email")
+	ErrIncorrectPassword   = errors.New("Password didn't match")
+	ErrTokenRevoked        = errors.New("Token revoked")
+	ErrTxReadOnly          = errors.New("Transaction is read-only")
+	ErrReadOnly            = errors.New("Database was opened read-only")
+	ErrLocked              = errors.New("Database is in use by another process")
+	ErrLiveSnapshot        = errors.New("Database is being written by another process and can't be read consistently")
+	ErrBackupNotFound      = errors.New("Backup doesn't exist")
+	ErrImportConflict      = errors.New("Record already exists")
+	ErrChecksumMismatch    = errors.New("Database checksum doesn't match its contents")
+	ErrEncrypted           = errors.New("Database is encrypted and no key was given")
+	ErrWrongKey            = errors.New("Database is encrypted with a different key")
+	ErrChangesUnavailable  = errors.New("Changes after that sequence number are no longer available")
+	ErrSubscriberLagged    = errors.New("Subscriber fell behind and missed changes")
+	ErrEmptySearch         = errors.New("Search has no words to look for")
+	ErrUnknownSearchOrder  = errors.New("Unknown search order, expected relevance or recent")
+	ErrSearchStatsMismatch = errors.New("Search stats don't match the terms of the query")
+)
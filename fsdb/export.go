@@ -0,0 +1,90 @@
+package fsdb
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	exportTypeUser         = "user"
+	exportTypeChirp        = "chirp"
+	exportTypeRevokedToken = "revoked_token"
+	exportTypeLike         = "like"
+)
+
+// exportLine is one line of an NDJSON export. Type says which of the other
+// fields is set. Users carry their password hash so they can still log in
+// after being imported elsewhere, and revoked tokens are only ever known by
+// their hash.
+type exportLine struct {
+	Type      string     `json:"type"`
+	User      *DBUser    `json:"user,omitempty"`
+	Chirp     *Chirp     `json:"chirp,omitempty"`
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Like      *Like      `json:"like,omitempty"`
+}
+
+// Export writes every user, chirp, like and revoked token as
+// newline-delimited JSON, one object per line. Soft-deleted chirps are
+// included with their tombstone. Users come first, then chirps, then likes,
+// and everything is ordered by id, so the output is stable and Import can
+// remap authors in a single pass.
+func (tx *Tx) Export(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+
+	userIds := make([]string, 0, len(tx.b.Users))
+	for id := range tx.b.Users {
+		userIds = append(userIds, id)
+	}
+	slices.SortFunc(userIds, compareIds)
+	for _, id := range userIds {
+		user := tx.b.Users[id]
+		if encodeErr := encoder.Encode(exportLine{Type: exportTypeUser, User: &user}); encodeErr != nil {
+			return encodeErr
+		}
+	}
+
+	chirpIds := make([]string, 0, len(tx.b.Chirps))
+	for id := range tx.b.Chirps {
+		chirpIds = append(chirpIds, id)
+	}
+	slices.SortFunc(chirpIds, compareIds)
+	for _, id := range chirpIds {
+		chirp := tx.b.Chirps[id]
+		if encodeErr := encoder.Encode(exportLine{Type: exportTypeChirp, Chirp: &chirp}); encodeErr != nil {
+			return encodeErr
+		}
+	}
+	for _, id := range chirpIds {
+		for _, like := range tx.b.likesOf(id) {
+			if encodeErr := encoder.Encode(exportLine{Type: exportTypeLike, Like: &like}); encodeErr != nil {
+				return encodeErr
+			}
+		}
+	}
+
+	tokenKeys := make([]string, 0, len(tx.b.RevokedTokens))
+	for tokenKey := range tx.b.RevokedTokens {
+		tokenKeys = append(tokenKeys, tokenKey)
+	}
+	sort.Strings(tokenKeys)
+	for _, tokenKey := range tokenKeys {
+		expiresAt := tx.b.RevokedTokens[tokenKey]
+		line := exportLine{Type: exportTypeRevokedToken, Token: tokenKey, ExpiresAt: &expiresAt}
+		if encodeErr := encoder.Encode(line); encodeErr != nil {
+			return encodeErr
+		}
+	}
+	return nil
+}
+
+// Export streams the content of store to w in the format of Tx.Export.
+func Export(store Store, w io.Writer) error {
+	return store.View(func(tx *Tx) error {
+		return tx.Export(w)
+	})
+}
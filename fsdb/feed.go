@@ -0,0 +1,237 @@
+package fsdb
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ChangeKind says what happened in a Change.
+type ChangeKind string
+
+const (
+	ChirpCreated   ChangeKind = "chirp.created"
+	ChirpDeleted   ChangeKind = "chirp.deleted"
+	ChirpUndeleted ChangeKind = "chirp.undeleted"
+	ChirpPurged    ChangeKind = "chirp.purged"
+	ChirpLiked     ChangeKind = "chirp.liked"
+	ChirpUnliked   ChangeKind = "chirp.unliked"
+	UserCreated    ChangeKind = "user.created"
+	UserUpdated    ChangeKind = "user.updated"
+	UserUpgraded   ChangeKind = "user.upgraded"
+	UserDeleted    ChangeKind = "user.deleted"
+	// DataReset means the whole database was replaced, for example by
+	// restoring a backup. Anything derived from earlier changes is stale.
+	DataReset ChangeKind = "reset"
+)
+
+// changeKinds maps the mutations that are published to their kind. Token
+// and metadata records are internal and not published.
+var changeKinds = map[recordOp]ChangeKind{
+	opChirpCreated:     ChirpCreated,
+	opChirpSoftDeleted: ChirpDeleted,
+	opChirpUndeleted:   ChirpUndeleted,
+	opChirpDeleted:     ChirpPurged,
+	opChirpLiked:       ChirpLiked,
+	opChirpUnliked:     ChirpUnliked,
+	opUserCreated:      UserCreated,
+	opUserUpdated:      UserUpdated,
+	opUserUpgraded:     UserUpgraded,
+	opUserDeleted:      UserDeleted,
+}
+
+// Change is an event published for every committed change to a chirp,
+// user or like. Seq increases by one with every change and keeps counting
+// across restarts, so sequence numbers are never reused. A subscriber can
+// resume where it left off with SubscribeAfter, but only while the database
+// stays open: the changes themselves are kept in memory. Chirp, User or Like
+// holds the entity after the change, or before it for deletions.
+type Change struct {
+	Seq   uint64     `json:"seq"`
+	Kind  ChangeKind `json:"kind"`
+	At    time.Time  `json:"at"`
+	Chirp *Chirp     `json:"chirp,omitempty"`
+	User  *User      `json:"user,omitempty"`
+	Like  *Like      `json:"like,omitempty"`
+}
+
+const (
+	// changeSeqKey is the metadata key holding the sequence number of the
+	// last published change.
+	changeSeqKey = "changeSeq"
+	// retainedChanges is how many of the latest changes are kept in memory
+	// for subscribers resuming with SubscribeAfter. None are kept across
+	// restarts.
+	retainedChanges = 1024
+)
+
+// Subscription delivers changes on C in sequence order. C is closed when the
+// subscription ends, after which Err says why.
+type Subscription struct {
+	C    <-chan Change
+	c    chan Change
+	feed *feed
+	err  error
+}
+
+// Err returns ErrSubscriberLagged if the subscriber fell so far behind that
+// changes had to be dropped, or nil if the subscription was closed. It must
+// only be called after C has been closed.
+func (sub *Subscription) Err() error {
+	return sub.err
+}
+
+// Close ends the subscription and closes C.
+func (sub *Subscription) Close() {
+	sub.feed.mu.Lock()
+	defer sub.feed.mu.Unlock()
+	sub.feed.end(sub, nil)
+}
+
+// feed publishes the changes committed to a database to its subscribers.
+type feed struct {
+	mu          sync.Mutex
+	seq         uint64
+	retained    []Change
+	subscribers map[*Subscription]struct{}
+}
+
+func newFeed(seq uint64) *feed {
+	return &feed{seq: seq, subscribers: make(map[*Subscription]struct{})}
+}
+
+func feedFromMetadata(dbStructure DBStructure) *feed {
+	seq, _ := strconv.ParseUint(dbStructure.Metadata[changeSeqKey], 10, 64)
+	return newFeed(seq)
+}
+
+// Subscribe delivers every change committed from now on. buffer is the
+// number of changes that may be pending before the subscriber is dropped.
+func (f *feed) Subscribe(buffer int) *Subscription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.subscribe(buffer, nil)
+}
+
+// SubscribeAfter delivers every change with a sequence number greater than
+// seq, starting with those already committed. It fails with
+// ErrChangesUnavailable if some of them are no longer retained, which is
+// always the case for changes committed before the database was opened; the
+// subscriber must then catch up by reading the current data.
+func (f *feed) SubscribeAfter(seq uint64, buffer int) (*Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if seq > f.seq {
+		return nil, ErrChangesUnavailable
+	}
+	missed := int(f.seq - seq)
+	if missed > len(f.retained) {
+		return nil, ErrChangesUnavailable
+	}
+	return f.subscribe(buffer, f.retained[len(f.retained)-missed:]), nil
+}
+
+func (f *feed) subscribe(buffer int, backlog []Change) *Subscription {
+	c := make(chan Change, max(buffer, 0)+len(backlog))
+	for _, change := range backlog {
+		c <- change
+	}
+	sub := &Subscription{C: c, c: c, feed: f}
+	f.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// end removes a subscriber. The caller must hold f.mu.
+func (f *feed) end(sub *Subscription, err error) {
+	if _, ok := f.subscribers[sub]; !ok {
+		return
+	}
+	delete(f.subscribers, sub)
+	sub.err = err
+	close(sub.c)
+}
+
+// prepare turns the records of a batch into changes and records the new
+// sequence number in the batch, so it is persisted along with them. The
+// changes must be passed to publish once the batch is committed.
+func (f *feed) prepare(b *batch) []Change {
+	f.mu.Lock()
+	seq := f.seq
+	f.mu.Unlock()
+	changes := []Change{}
+	for _, rec := range b.records {
+		kind, published := changeKinds[rec.Op]
+		if !published {
+			continue
+		}
+		seq++
+		change := Change{Seq: seq, Kind: kind, At: b.now}
+		if rec.Chirp != nil {
+			chirp := *rec.Chirp
+			change.Chirp = &chirp
+		}
+		if rec.User != nil {
+			user := rec.User.User
+			change.User = &user
+		}
+		if rec.Like != nil {
+			like := *rec.Like
+			change.Like = &like
+		}
+		changes = append(changes, change)
+	}
+	if len(changes) > 0 {
+		b.setMetadata(changeSeqKey, strconv.FormatUint(seq, 10))
+	}
+	return changes
+}
+
+// prepareReset returns the change announcing that dbStructure replaces all
+// data, and moves its sequence number past the current one so numbers never
+// go back.
+func (f *feed) prepareReset(dbStructure *DBStructure) Change {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	change := Change{Seq: f.seq + 1, Kind: DataReset, At: time.Now().UTC()}
+	dbStructure.Metadata[changeSeqKey] = strconv.FormatUint(change.Seq, 10)
+	return change
+}
+
+// publish delivers committed changes. Callers must hold the database's
+// write lock, so changes are published in sequence order. Subscribers whose
+// buffer is full are dropped rather than allowed to hold up writers.
+func (f *feed) publish(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq = changes[len(changes)-1].Seq
+	f.retained = append(f.retained, changes...)
+	if excess := len(f.retained) - retainedChanges; excess > 0 {
+		f.retained = append([]Change(nil), f.retained[excess:]...)
+	}
+	for sub := range f.subscribers {
+		for _, change := range changes {
+			delivered := true
+			select {
+			case sub.c <- change:
+			default:
+				delivered = false
+			}
+			if !delivered {
+				f.end(sub, ErrSubscriberLagged)
+				break
+			}
+		}
+	}
+}
+
+// closeAll ends every subscription, as happens when the database is closed.
+func (f *feed) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subscribers {
+		f.end(sub, nil)
+	}
+}
@@ -0,0 +1,135 @@
+package fsdb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	backupSuffix  = ".bak"
+	lockSuffix    = ".lock"
+	tempInfix     = ".tmp-"
+	corruptSuffix = ".corrupt-"
+	// preMigrationInfix names the copy of a file kept before migrating it,
+	// followed by the schema version it had.
+	preMigrationInfix = ".schema-v"
+)
+
+// atomicWriteFile replaces path with dat without ever leaving a partially
+// written file behind. The data goes to a temporary file in the same
+// directory which is fsynced and then renamed over path. If keepBackup is
+// set, the previous contents of path are kept as path.bak first.
+func atomicWriteFile(path string, dat []byte, keepBackup bool) error {
+	dir := filepath.Dir(path)
+	tmp, createErr := os.CreateTemp(dir, filepath.Base(path)+tempInfix+"*")
+	if createErr != nil {
+		return createErr
+	}
+	tmpPath := tmp.Name()
+	cleanUp := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if _, writeErr := tmp.Write(dat); writeErr != nil {
+		return cleanUp(writeErr)
+	}
+	if syncErr := tmp.Sync(); syncErr != nil {
+		return cleanUp(syncErr)
+	}
+	if closeErr := tmp.Close(); closeErr != nil {
+		return cleanUp(closeErr)
+	}
+	if chmodErr := os.Chmod(tmpPath, 0666); chmodErr != nil {
+		return cleanUp(chmodErr)
+	}
+	if keepBackup {
+		if backupErr := backupFile(path); backupErr != nil {
+			return cleanUp(backupErr)
+		}
+	}
+	if renameErr := os.Rename(tmpPath, path); renameErr != nil {
+		return cleanUp(renameErr)
+	}
+	return syncDir(dir)
+}
+
+// backupFile makes path.bak refer to the current contents of path. A hard
+// link is used where possible so the backup costs no extra writes; the
+// subsequent rename in atomicWriteFile then leaves the link pointing at the
+// old data.
+func backupFile(path string) error {
+	backupPath := path + backupSuffix
+	if removeErr := os.Remove(backupPath); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+		return removeErr
+	}
+	linkErr := os.Link(path, backupPath)
+	if linkErr == nil || errors.Is(linkErr, os.ErrNotExist) {
+		return nil
+	}
+	return copyFile(path, backupPath)
+}
+
+func copyFile(src, dst string) error {
+	in, openErr := os.Open(src)
+	if openErr != nil {
+		return openErr
+	}
+	defer in.Close()
+	out, createErr := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if createErr != nil {
+		return createErr
+	}
+	if _, copyErr := io.Copy(out, in); copyErr != nil {
+		out.Close()
+		return copyErr
+	}
+	if syncErr := out.Sync(); syncErr != nil {
+		out.Close()
+		return syncErr
+	}
+	return out.Close()
+}
+
+// syncDir flushes directory metadata so a completed rename survives a crash.
+// Not every platform supports syncing a directory, so failures are ignored.
+func syncDir(dir string) error {
+	d, openErr := os.Open(dir)
+	if openErr != nil {
+		return openErr
+	}
+	d.Sync()
+	return d.Close()
+}
+
+// removeStaleTempFiles deletes temporary files left over from writes that
+// were interrupted before their rename, including those of the files inside
+// a sharded database.
+func removeStaleTempFiles(path string) {
+	matches, _ := filepath.Glob(path + tempInfix + "*")
+	inside, _ := filepath.Glob(filepath.Join(path, "*"+tempInfix+"*"))
+	matches = append(matches, inside...)
+	for _, match := range matches {
+		os.Remove(match)
+	}
+}
+
+// RemoveFiles deletes the database at path together with every auxiliary
+// file fsdb keeps next to it. A sharded database is removed with its whole
+// directory.
+func RemoveFiles(path string) error {
+	removeStaleTempFiles(path)
+	files := []string{path, path + backupSuffix, path + walSuffix, path + lockSuffix}
+	for _, infix := range []string{corruptSuffix, preMigrationInfix} {
+		matches, _ := filepath.Glob(path + infix + "*")
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		if removeErr := os.RemoveAll(file); removeErr != nil {
+			return removeErr
+		}
+	}
+	return nil
+}
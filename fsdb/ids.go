@@ -0,0 +1,156 @@
+package fsdb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdStrategy decides which ids new users and chirps get. The strategy is
+// stored with the data, so every program writing to a database hands out the
+// same kind of ids; see Tx.SetIdStrategy.
+type IdStrategy string
+
+const (
+	// SequentialIds numbers users and chirps 1, 2, 3 and so on. The ids are
+	// short, but reveal how many there are and are easy to guess.
+	SequentialIds IdStrategy = "sequential"
+	// UUIDv7Ids hands out random UUIDs that start with the time they were
+	// made, so they still sort in creation order.
+	UUIDv7Ids IdStrategy = "uuidv7"
+)
+
+// idStrategyKey is the metadata key holding the id strategy. Databases
+// without it use SequentialIds.
+const idStrategyKey = "idStrategy"
+
+// ParseIdStrategy accepts the names "sequential" and "uuidv7".
+func ParseIdStrategy(name string) (IdStrategy, error) {
+	switch strategy := IdStrategy(name); strategy {
+	case SequentialIds, UUIDv7Ids:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown id strategy %q, expected sequential or uuidv7", name)
+	}
+}
+
+// IdStrategy returns the strategy new ids are made with.
+func (tx *Tx) IdStrategy() IdStrategy {
+	if strategy := IdStrategy(tx.b.Metadata[idStrategyKey]); strategy != "" {
+		return strategy
+	}
+	return SequentialIds
+}
+
+// SetIdStrategy changes how ids are made from now on. Existing users and
+// chirps keep their ids, and ids of either kind can be looked up at any time.
+func (tx *Tx) SetIdStrategy(strategy IdStrategy) error {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return writableErr
+	}
+	if _, parseErr := ParseIdStrategy(string(strategy)); parseErr != nil {
+		return parseErr
+	}
+	if strategy == tx.IdStrategy() {
+		return nil
+	}
+	tx.b.setMetadata(idStrategyKey, string(strategy))
+	return nil
+}
+
+// newId returns an id for a new entity. Sequential ids come from the counter
+// stored in the metadata under counterKey.
+func (b *batch) newId(counterKey string) (string, error) {
+	if IdStrategy(b.Metadata[idStrategyKey]) == UUIDv7Ids {
+		return newUUIDv7(b.now)
+	}
+	return b.takeNextId(counterKey)
+}
+
+// numericId returns the value of an id that is a plain decimal number, as
+// handed out by SequentialIds and by every version of fsdb before ids were
+// strings.
+func numericId(id string) (int, bool) {
+	if id == "" || id[0] < '0' || id[0] > '9' {
+		return 0, false
+	}
+	n, atoiErr := strconv.Atoi(id)
+	return n, atoiErr == nil
+}
+
+// maxNumericId returns the highest numeric id of a collection, or zero if it
+// has none.
+func maxNumericId[V any](collection map[string]V) int {
+	maxId := 0
+	for id := range collection {
+		if n, ok := numericId(id); ok {
+			maxId = max(maxId, n)
+		}
+	}
+	return maxId
+}
+
+// compareIds orders ids by age. Numeric ids are older than any other and
+// compare by value; other ids, such as UUIDv7 ones, compare byte by byte,
+// which is their creation order.
+func compareIds(a, b string) int {
+	aNum, aIsNum := numericId(a)
+	bNum, bIsNum := numericId(b)
+	switch {
+	case aIsNum && bIsNum && aNum != bNum:
+		if aNum < bNum {
+			return -1
+		}
+		return 1
+	case aIsNum != bIsNum:
+		if aIsNum {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// uuidv7Clock keeps UUIDv7 ids made within the same millisecond in order by
+// counting in the 12 bits that follow the timestamp, as RFC 9562 allows.
+var uuidv7Clock struct {
+	mu      sync.Mutex
+	lastMs  int64
+	counter uint16
+}
+
+func newUUIDv7(now time.Time) (string, error) {
+	var id [16]byte
+	if _, randErr := rand.Read(id[6:]); randErr != nil {
+		return "", randErr
+	}
+	uuidv7Clock.mu.Lock()
+	ms := now.UnixMilli()
+	if ms <= uuidv7Clock.lastMs {
+		ms = uuidv7Clock.lastMs
+		uuidv7Clock.counter++
+		if uuidv7Clock.counter > 0xfff {
+			ms++
+			uuidv7Clock.counter = 0
+		}
+	} else {
+		uuidv7Clock.counter = binary.BigEndian.Uint16(id[6:8]) & 0x7ff
+	}
+	uuidv7Clock.lastMs = ms
+	counter := uuidv7Clock.counter
+	uuidv7Clock.mu.Unlock()
+
+	var msBytes [8]byte
+	binary.BigEndian.PutUint64(msBytes[:], uint64(ms))
+	copy(id[:6], msBytes[2:])
+	binary.BigEndian.PutUint16(id[6:8], 0x7000|counter)
+	id[8] = 0x80 | id[8]&0x3f
+
+	encoded := hex.EncodeToString(id[:])
+	return encoded[:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:], nil
+}
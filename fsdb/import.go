@@ -0,0 +1,369 @@
+package fsdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ConflictPolicy decides what Import does with a record that already exists
+// in the database: a user with the same email, or, when ids are kept, a user
+// or chirp with the same id.
+type ConflictPolicy int
+
+const (
+	// ConflictFail aborts the import with ErrImportConflict. Nothing is
+	// written in that case.
+	ConflictFail ConflictPolicy = iota
+	// ConflictSkip keeps the existing record.
+	ConflictSkip
+	// ConflictOverwrite replaces the existing record with the imported one.
+	ConflictOverwrite
+)
+
+var conflictPolicyNames = map[ConflictPolicy]string{
+	ConflictFail:      "fail",
+	ConflictSkip:      "skip",
+	ConflictOverwrite: "overwrite",
+}
+
+func (policy ConflictPolicy) String() string {
+	return conflictPolicyNames[policy]
+}
+
+// ParseConflictPolicy accepts the names "fail", "skip" and "overwrite".
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for policy, policyName := range conflictPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict policy %q, expected fail, skip or overwrite", name)
+}
+
+// ImportOptions configures Import. The zero value assigns new ids and fails
+// on conflicts.
+type ImportOptions struct {
+	OnConflict ConflictPolicy
+	// KeepIds stores users and chirps under the ids they have in the export
+	// instead of assigning new ones. Chirps whose author isn't in the
+	// database are skipped, and replies to chirps that aren't in it once
+	// the import is done become chirps of their own.
+	KeepIds bool
+}
+
+// ImportCounts tallies what happened to the records of one collection.
+type ImportCounts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+// ImportReport describes the outcome of an import.
+type ImportReport struct {
+	Users         ImportCounts `json:"users"`
+	Chirps        ImportCounts `json:"chirps"`
+	Likes         ImportCounts `json:"likes"`
+	RevokedTokens ImportCounts `json:"revoked_tokens"`
+}
+
+func (report ImportReport) String() string {
+	return fmt.Sprintf("users: %+v, chirps: %+v, likes: %+v, revoked tokens: %+v", report.Users, report.Chirps, report.Likes, report.RevokedTokens)
+}
+
+// importer applies the lines of an export to a batch. userIds and chirpIds
+// map ids in the export to the ids the users and chirps ended up with in the
+// database. keptReplies lists the replies imported with KeepIds, whose
+// parents may only come later in the export.
+type importer struct {
+	b           *batch
+	options     ImportOptions
+	userIds     map[string]string
+	chirpIds    map[string]string
+	keptReplies []string
+	report      ImportReport
+}
+
+func (imp *importer) conflict(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrImportConflict, fmt.Sprintf(format, args...))
+}
+
+// stamp fills in timestamps missing from exports written before they existed.
+func (imp *importer) stamp(createdAt, updatedAt *time.Time) {
+	if createdAt.IsZero() {
+		*createdAt = imp.b.now
+	}
+	if updatedAt.IsZero() {
+		*updatedAt = *createdAt
+	}
+}
+
+// importUser adds a user. Handles are unique, so a user whose handle
+// belongs to someone else in the database is imported without one.
+func (imp *importer) importUser(user DBUser) error {
+	exportedId := user.Id
+	imp.stamp(&user.CreatedAt, &user.UpdatedAt)
+	existing, emailTaken := imp.b.userByEmail(user.Email)
+	if imp.options.KeepIds {
+		if emailTaken && existing.Id != user.Id {
+			if imp.options.OnConflict == ConflictSkip {
+				imp.report.Users.Skipped++
+				return nil
+			}
+			// Overwriting would leave two users with the same email.
+			return imp.conflict("user %s has the email %s of user %s", user.Id, user.Email, existing.Id)
+		}
+		existing, emailTaken = imp.b.Users[user.Id]
+	}
+	if !emailTaken {
+		if imp.options.KeepIds {
+			if reserveErr := imp.b.reserveId("nextUserId", user.Id); reserveErr != nil {
+				return reserveErr
+			}
+		} else {
+			nextUserId, idErr := imp.b.newId("nextUserId")
+			if idErr != nil {
+				return idErr
+			}
+			user.Id = nextUserId
+		}
+		user.Handle = imp.handleFor(user)
+		imp.b.putUser(opUserCreated, user)
+		imp.userIds[exportedId] = user.Id
+		imp.report.Users.Created++
+		return nil
+	}
+
+	switch imp.options.OnConflict {
+	case ConflictSkip:
+		imp.report.Users.Skipped++
+	case ConflictOverwrite:
+		user.Id = existing.Id
+		user.Handle = imp.handleFor(user)
+		imp.b.putUser(opUserUpdated, user)
+		imp.report.Users.Updated++
+	default:
+		return imp.conflict("user %s", user.Email)
+	}
+	imp.userIds[exportedId] = existing.Id
+	return nil
+}
+
+// handleFor returns the handle of an imported user, or nothing if another
+// user has it or it isn't valid.
+func (imp *importer) handleFor(user DBUser) string {
+	if user.Handle == "" {
+		return ""
+	}
+	handle, handleErr := imp.b.claimHandle(user.Id, user.Handle)
+	if handleErr != nil {
+		return ""
+	}
+	return handle
+}
+
+// importChirp adds a chirp. When ids are assigned anew, chirps whose author
+// wasn't part of the import are skipped, as there is nobody to attribute them
+// to, and replies to chirps that weren't become chirps of their own. Hashtags
+// and mentions are extracted again, as mentions have to name users of this
+// database.
+func (imp *importer) importChirp(chirp Chirp) error {
+	imp.stamp(&chirp.CreatedAt, &chirp.UpdatedAt)
+	imp.b.extractEntities(&chirp)
+	if !imp.options.KeepIds {
+		authorId, known := imp.userIds[chirp.AuthorId]
+		if !known {
+			imp.report.Chirps.Skipped++
+			return nil
+		}
+		nextChirpId, idErr := imp.b.newId("nextChirpId")
+		if idErr != nil {
+			return idErr
+		}
+		parentId, parentKnown := imp.chirpIds[chirp.InReplyTo]
+		if parentKnown {
+			chirp.InReplyTo = parentId
+			chirp.RootId = imp.b.Chirps[parentId].threadRootId()
+		} else {
+			chirp.InReplyTo, chirp.RootId = "", ""
+		}
+		imp.chirpIds[chirp.Id] = nextChirpId
+		chirp.AuthorId = authorId
+		chirp.Id = nextChirpId
+		imp.b.putChirp(opChirpCreated, chirp)
+		imp.report.Chirps.Created++
+		return nil
+	}
+
+	if _, authorExists := imp.b.Users[chirp.AuthorId]; !authorExists {
+		imp.report.Chirps.Skipped++
+		return nil
+	}
+	if chirp.InReplyTo != "" {
+		imp.keptReplies = append(imp.keptReplies, chirp.Id)
+	}
+	if _, exists := imp.b.Chirps[chirp.Id]; !exists {
+		if reserveErr := imp.b.reserveId("nextChirpId", chirp.Id); reserveErr != nil {
+			return reserveErr
+		}
+		imp.b.putChirp(opChirpCreated, chirp)
+		imp.report.Chirps.Created++
+		return nil
+	}
+	switch imp.options.OnConflict {
+	case ConflictSkip:
+		imp.report.Chirps.Skipped++
+	case ConflictOverwrite:
+		if chirp.DeletedAt != nil {
+			imp.b.unlikeAll(chirp.Id)
+		}
+		imp.b.putChirp(opChirpCreated, chirp)
+		imp.report.Chirps.Updated++
+	default:
+		return imp.conflict("chirp %s", chirp.Id)
+	}
+	return nil
+}
+
+// linkKeptReplies detaches the replies imported with KeepIds from parents
+// that aren't in the database, then points every one of them at the chirp
+// that starts its conversation now. Replies caught in a cycle are detached
+// too.
+func (imp *importer) linkKeptReplies() {
+	for _, id := range imp.keptReplies {
+		reply, exists := imp.b.Chirps[id]
+		if !exists || reply.InReplyTo == "" {
+			continue
+		}
+		if _, parentExists := imp.b.Chirps[reply.InReplyTo]; !parentExists {
+			reply.InReplyTo, reply.RootId = "", ""
+			imp.b.putChirp(opChirpCreated, reply)
+		}
+	}
+	for _, id := range imp.keptReplies {
+		reply, exists := imp.b.Chirps[id]
+		if !exists || reply.InReplyTo == "" {
+			continue
+		}
+		rootId, linked := imp.b.conversationStart(reply)
+		if !linked {
+			reply.InReplyTo = ""
+		}
+		if !linked || rootId != reply.RootId {
+			reply.RootId = rootId
+			imp.b.putChirp(opChirpCreated, reply)
+		}
+	}
+}
+
+// importLike adds a like. Likes of chirps or by users that aren't in the
+// database, or of deleted chirps, are skipped, and so are likes the database
+// already has.
+func (imp *importer) importLike(like Like) {
+	if !imp.options.KeepIds {
+		like.ChirpId = imp.chirpIds[like.ChirpId]
+		like.UserId = imp.userIds[like.UserId]
+	}
+	chirp, chirpExists := imp.b.Chirps[like.ChirpId]
+	_, userExists := imp.b.Users[like.UserId]
+	_, liked := imp.b.Likes[like.ChirpId][like.UserId]
+	if !chirpExists || chirp.DeletedAt != nil || !userExists || liked {
+		imp.report.Likes.Skipped++
+		return
+	}
+	if like.LikedAt.IsZero() {
+		like.LikedAt = imp.b.now
+	}
+	imp.b.putLike(opChirpLiked, like)
+	imp.report.Likes.Created++
+}
+
+// importRevokedToken merges a revoked token. Revoking a token twice is never
+// a conflict; the later expiry wins.
+func (imp *importer) importRevokedToken(tokenKey string, expiresAt time.Time) {
+	current, exists := imp.b.RevokedTokens[tokenKey]
+	switch {
+	case !exists:
+		imp.b.putRevokedToken(tokenKey, expiresAt)
+		imp.report.RevokedTokens.Created++
+	case expiresAt.After(current):
+		imp.b.putRevokedToken(tokenKey, expiresAt)
+		imp.report.RevokedTokens.Updated++
+	default:
+		imp.report.RevokedTokens.Skipped++
+	}
+}
+
+func (imp *importer) importLine(line exportLine) error {
+	switch {
+	case line.Type == exportTypeUser && line.User != nil:
+		return imp.importUser(*line.User)
+	case line.Type == exportTypeChirp && line.Chirp != nil:
+		return imp.importChirp(*line.Chirp)
+	case line.Type == exportTypeLike && line.Like != nil:
+		imp.importLike(*line.Like)
+		return nil
+	case line.Type == exportTypeRevokedToken && line.Token != "" && line.ExpiresAt != nil:
+		imp.importRevokedToken(line.Token, *line.ExpiresAt)
+		return nil
+	default:
+		return fmt.Errorf("unknown or incomplete record of type %q", line.Type)
+	}
+}
+
+// Import reads an export written by Tx.Export and adds its records to the
+// database. Users must appear before the chirps they wrote, and chirps
+// before their likes and, unless ids are kept, before the replies to them.
+// Without KeepIds every chirp is added as a new one, so importing the same
+// export twice duplicates its chirps. Blank lines are ignored.
+func (tx *Tx) Import(r io.Reader, options ImportOptions) (ImportReport, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return ImportReport{}, writableErr
+	}
+	imp := &importer{b: tx.b, options: options, userIds: make(map[string]string), chirpIds: make(map[string]string)}
+	reader := bufio.NewReader(r)
+	for lineNumber := 1; ; lineNumber++ {
+		dat, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return ImportReport{}, readErr
+		}
+		if dat = bytes.TrimSpace(dat); len(dat) > 0 {
+			// Exports written by older versions are upgraded like journal
+			// records.
+			upgraded, upgradeErr := upgradeRecord(dat)
+			if upgradeErr != nil {
+				return ImportReport{}, fmt.Errorf("line %d: %w", lineNumber, upgradeErr)
+			}
+			line := exportLine{}
+			if unmarshalErr := json.Unmarshal(upgraded, &line); unmarshalErr != nil {
+				return ImportReport{}, fmt.Errorf("line %d: %w", lineNumber, unmarshalErr)
+			}
+			if importErr := imp.importLine(line); importErr != nil {
+				return ImportReport{}, fmt.Errorf("line %d: %w", lineNumber, importErr)
+			}
+		}
+		if readErr != nil {
+			imp.linkKeptReplies()
+			return imp.report, nil
+		}
+	}
+}
+
+// Import adds the records read from r to store in a single transaction, so
+// either all of them are stored or, if any line fails, none are.
+func Import(store Store, r io.Reader, options ImportOptions) (ImportReport, error) {
+	var report ImportReport
+	err := store.Update(func(tx *Tx) error {
+		var importErr error
+		report, importErr = tx.Import(r, options)
+		return importErr
+	})
+	if err != nil {
+		return ImportReport{}, err
+	}
+	return report, nil
+}
@@ -0,0 +1,71 @@
+package fsdb
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestImportKeepingIdsLeavesNoOrphans(t *testing.T) {
+	export := strings.Join([]string{
+		`{"type":"user","user":{"id":"1","email":"a@x.com","password":"x"}}`,
+		`{"type":"chirp","chirp":{"id":"1","author_id":"9","body":"by nobody"}}`,
+		`{"type":"chirp","chirp":{"id":"2","author_id":"1","body":"reply to a later chirp","in_reply_to":"5","root_id":"5"}}`,
+		`{"type":"chirp","chirp":{"id":"3","author_id":"1","body":"reply to a missing chirp","in_reply_to":"8","root_id":"8"}}`,
+		`{"type":"chirp","chirp":{"id":"4","author_id":"1","body":"reply to that reply","in_reply_to":"3","root_id":"8"}}`,
+		`{"type":"chirp","chirp":{"id":"5","author_id":"1","body":"root"}}`,
+	}, "\n")
+	db := NewMemDB()
+	report, importErr := Import(db, strings.NewReader(export), ImportOptions{KeepIds: true})
+	if importErr != nil {
+		t.Fatal(importErr)
+	}
+	if report.Chirps.Created != 4 || report.Chirps.Skipped != 1 {
+		t.Errorf("got chirps %+v, want 4 created and 1 skipped", report.Chirps)
+	}
+
+	for _, want := range []struct{ id, inReplyTo, rootId string }{
+		{"2", "5", "5"},
+		{"3", "", ""},
+		{"4", "3", "3"},
+	} {
+		chirp, getErr := db.GetUniqueChirp(want.id)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		if chirp.InReplyTo != want.inReplyTo || chirp.RootId != want.rootId {
+			t.Errorf("chirp %s: got in_reply_to %q and root_id %q, want %q and %q", want.id, chirp.InReplyTo, chirp.RootId, want.inReplyTo, want.rootId)
+		}
+	}
+	var problems []IntegrityProblem
+	viewErr := db.View(func(tx *Tx) error {
+		var checkErr error
+		problems, checkErr = tx.CheckIntegrity()
+		return checkErr
+	})
+	if viewErr != nil {
+		t.Fatal(viewErr)
+	}
+	if len(problems) != 0 {
+		t.Errorf("got integrity problems %v", problems)
+	}
+}
+
+func TestImportOverwritingLikedChirpKeepsLikesInOrder(t *testing.T) {
+	db := importChirpsOutOfIdOrder(t)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		if _, likeErr := db.LikeChirp(id, "1"); likeErr != nil {
+			t.Fatal(likeErr)
+		}
+	}
+	// "first" becomes the newest chirp.
+	export := `{"type":"chirp","chirp":{"id":"2","author_id":"1","body":"first","created_at":"2024-01-04T00:00:00Z"}}`
+	if _, importErr := Import(db, strings.NewReader(export), ImportOptions{KeepIds: true, OnConflict: ConflictOverwrite}); importErr != nil {
+		t.Fatal(importErr)
+	}
+
+	want := []string{"also first", "second", "third", "first"}
+	if got := readPages(t, db, ChirpQuery{LikedByUserId: "1"}, nil); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,271 @@
+package fsdb
+
+import (
+	"slices"
+	"time"
+)
+
+// indexes are derived lookups over a DBStructure. They are never persisted:
+// rebuildIndexes recreates them after loading, and every change to chirps
+// or users afterwards must go through the setters below to keep them in sync.
+// Soft-deleted chirps are listed in deletedChirpIds and, to keep
+// conversations together, in chirpsByRoot; the other chirp indexes only
+// cover live ones. chirpsByRoot lists the replies in each conversation under
+// the id of the chirp that started it. chirpsLikedBy lists the chirps each
+// user likes.
+//
+// chirpIds, the chirps by author, hashtag, mention, like and conversation,
+// and the text index list chirps in the order of compareChirps, which is the
+// order they were created in; deletedChirpIds is in the order of compareIds.
+type indexes struct {
+	userIdByEmail   map[string]string
+	userIdByHandle  map[string]string
+	chirpsByAuthor  map[string][]string
+	chirpsByHashtag map[string][]string
+	chirpsByMention map[string][]string
+	chirpsByRoot    map[string][]string
+	chirpsLikedBy   map[string][]string
+	chirpIds        []string
+	deletedChirpIds []string
+	text            *textIndex
+	compareChirps   func(a, b string) int
+}
+
+func (dbStructure *DBStructure) rebuildIndexes() {
+	chirps := dbStructure.Chirps
+	compareChirps := func(a, b string) int {
+		return comparePositions(chirps[a].CreatedAt, a, chirps[b].CreatedAt, b)
+	}
+	idx := &indexes{
+		userIdByEmail:   make(map[string]string, len(dbStructure.Users)),
+		userIdByHandle:  make(map[string]string, len(dbStructure.Users)),
+		chirpsByAuthor:  make(map[string][]string),
+		chirpsByHashtag: make(map[string][]string),
+		chirpsByMention: make(map[string][]string),
+		chirpsByRoot:    make(map[string][]string),
+		chirpsLikedBy:   make(map[string][]string),
+		chirpIds:        make([]string, 0, len(dbStructure.Chirps)),
+		text:            newTextIndex(compareChirps),
+		compareChirps:   compareChirps,
+	}
+	for id, user := range dbStructure.Users {
+		idx.userIdByEmail[user.Email] = id
+		// Only a damaged file has several users with a handle; the oldest
+		// is the one mentioned.
+		if owner, taken := idx.userIdByHandle[user.Handle]; user.Handle != "" && (!taken || compareIds(id, owner) < 0) {
+			idx.userIdByHandle[user.Handle] = id
+		}
+	}
+	for id, chirp := range dbStructure.Chirps {
+		// The stored count is only a copy; the likes are what counts.
+		chirp.LikeCount = len(dbStructure.Likes[id])
+		dbStructure.Chirps[id] = chirp
+		if chirp.RootId != "" {
+			idx.chirpsByRoot[chirp.RootId] = append(idx.chirpsByRoot[chirp.RootId], id)
+		}
+		if chirp.DeletedAt != nil {
+			idx.deletedChirpIds = append(idx.deletedChirpIds, id)
+			continue
+		}
+		idx.chirpIds = append(idx.chirpIds, id)
+		idx.chirpsByAuthor[chirp.AuthorId] = append(idx.chirpsByAuthor[chirp.AuthorId], id)
+	}
+	slices.SortFunc(idx.chirpIds, compareChirps)
+	slices.SortFunc(idx.deletedChirpIds, compareIds)
+	for _, ids := range idx.chirpsByAuthor {
+		slices.SortFunc(ids, compareChirps)
+	}
+	for _, ids := range idx.chirpsByRoot {
+		slices.SortFunc(ids, compareChirps)
+	}
+	for chirpId, likes := range dbStructure.Likes {
+		for userId := range likes {
+			idx.chirpsLikedBy[userId] = append(idx.chirpsLikedBy[userId], chirpId)
+		}
+	}
+	for _, ids := range idx.chirpsLikedBy {
+		slices.SortFunc(ids, compareChirps)
+	}
+	// In creation order, indexing text and entities only ever appends.
+	for _, id := range idx.chirpIds {
+		idx.text.add(chirps[id])
+		idx.indexEntities(chirps[id])
+	}
+	dbStructure.indexes = idx
+}
+
+func (idx *indexes) indexEntities(chirp Chirp) {
+	for _, hashtag := range chirp.Hashtags {
+		idx.chirpsByHashtag[hashtag.Tag] = insertSorted(idx.chirpsByHashtag[hashtag.Tag], chirp.Id, idx.compareChirps)
+	}
+	for _, mention := range chirp.Mentions {
+		idx.chirpsByMention[mention.UserId] = insertSorted(idx.chirpsByMention[mention.UserId], chirp.Id, idx.compareChirps)
+	}
+}
+
+func (idx *indexes) unindexEntities(chirp Chirp) {
+	for _, hashtag := range chirp.Hashtags {
+		removeFromIndex(idx.chirpsByHashtag, hashtag.Tag, chirp.Id, idx.compareChirps)
+	}
+	for _, mention := range chirp.Mentions {
+		removeFromIndex(idx.chirpsByMention, mention.UserId, chirp.Id, idx.compareChirps)
+	}
+}
+
+// removeFromIndex removes id from the ids listed under key, dropping the key
+// once no ids are left.
+func removeFromIndex(index map[string][]string, key, id string, compare func(a, b string) int) {
+	ids := removeSorted(index[key], id, compare)
+	if len(ids) == 0 {
+		delete(index, key)
+		return
+	}
+	index[key] = ids
+}
+
+// insertSorted adds id to ids, which are kept in the order of compare. New
+// chirps almost always come last, so appending is tried first.
+func insertSorted(ids []string, id string, compare func(a, b string) int) []string {
+	if len(ids) == 0 || compare(ids[len(ids)-1], id) < 0 {
+		return append(ids, id)
+	}
+	pos, found := slices.BinarySearchFunc(ids, id, compare)
+	if found {
+		return ids
+	}
+	return slices.Insert(ids, pos, id)
+}
+
+func removeSorted(ids []string, id string, compare func(a, b string) int) []string {
+	pos, found := slices.BinarySearchFunc(ids, id, compare)
+	if !found {
+		return ids
+	}
+	return slices.Delete(ids, pos, pos+1)
+}
+
+func (dbStructure *DBStructure) setChirp(chirp Chirp) {
+	idx := dbStructure.indexes
+	// A new creation time moves the chirp within the likes of its likers;
+	// it is taken out under the old one, before that is overwritten.
+	prev, existed := dbStructure.Chirps[chirp.Id]
+	moved := existed && !prev.CreatedAt.Equal(chirp.CreatedAt)
+	if moved {
+		for userId := range dbStructure.Likes[chirp.Id] {
+			removeFromIndex(idx.chirpsLikedBy, userId, chirp.Id, idx.compareChirps)
+		}
+	}
+	dbStructure.unindexChirp(chirp.Id)
+	// The chirp is stored first, as compareChirps looks up its creation time.
+	chirp.LikeCount = len(dbStructure.Likes[chirp.Id])
+	dbStructure.Chirps[chirp.Id] = chirp
+	if moved {
+		for userId := range dbStructure.Likes[chirp.Id] {
+			idx.chirpsLikedBy[userId] = insertSorted(idx.chirpsLikedBy[userId], chirp.Id, idx.compareChirps)
+		}
+	}
+	if chirp.RootId != "" {
+		idx.chirpsByRoot[chirp.RootId] = insertSorted(idx.chirpsByRoot[chirp.RootId], chirp.Id, idx.compareChirps)
+	}
+	if chirp.DeletedAt != nil {
+		idx.deletedChirpIds = insertSorted(idx.deletedChirpIds, chirp.Id, compareIds)
+	} else {
+		idx.chirpIds = insertSorted(idx.chirpIds, chirp.Id, idx.compareChirps)
+		idx.chirpsByAuthor[chirp.AuthorId] = insertSorted(idx.chirpsByAuthor[chirp.AuthorId], chirp.Id, idx.compareChirps)
+		idx.text.add(chirp)
+		idx.indexEntities(chirp)
+	}
+}
+
+func (dbStructure *DBStructure) removeChirp(chirpId string) {
+	dbStructure.unindexChirp(chirpId)
+	delete(dbStructure.Chirps, chirpId)
+}
+
+// unindexChirp drops the stored version of a chirp from the indexes.
+func (dbStructure *DBStructure) unindexChirp(chirpId string) {
+	chirp, existed := dbStructure.Chirps[chirpId]
+	if !existed {
+		return
+	}
+	idx := dbStructure.indexes
+	if chirp.RootId != "" {
+		removeFromIndex(idx.chirpsByRoot, chirp.RootId, chirpId, idx.compareChirps)
+	}
+	if chirp.DeletedAt != nil {
+		idx.deletedChirpIds = removeSorted(idx.deletedChirpIds, chirpId, compareIds)
+		return
+	}
+	idx.chirpIds = removeSorted(idx.chirpIds, chirpId, idx.compareChirps)
+	idx.text.remove(chirp)
+	idx.unindexEntities(chirp)
+	removeFromIndex(idx.chirpsByAuthor, chirp.AuthorId, chirpId, idx.compareChirps)
+}
+
+func (dbStructure *DBStructure) setUser(user DBUser) {
+	idx := dbStructure.indexes
+	if prev, existed := dbStructure.Users[user.Id]; existed {
+		if prev.Email != user.Email && idx.userIdByEmail[prev.Email] == user.Id {
+			delete(idx.userIdByEmail, prev.Email)
+		}
+		if prev.Handle != user.Handle && idx.userIdByHandle[prev.Handle] == user.Id {
+			delete(idx.userIdByHandle, prev.Handle)
+		}
+	}
+	idx.userIdByEmail[user.Email] = user.Id
+	if user.Handle != "" {
+		idx.userIdByHandle[user.Handle] = user.Id
+	}
+	dbStructure.Users[user.Id] = user
+}
+
+func (dbStructure *DBStructure) removeUser(userId string) {
+	user, existed := dbStructure.Users[userId]
+	if !existed {
+		return
+	}
+	delete(dbStructure.Users, userId)
+	if dbStructure.indexes.userIdByHandle[user.Handle] == userId {
+		delete(dbStructure.indexes.userIdByHandle, user.Handle)
+	}
+	if dbStructure.indexes.userIdByEmail[user.Email] != userId {
+		return
+	}
+	delete(dbStructure.indexes.userIdByEmail, user.Email)
+	// Only a damaged file can have another user with the same email, but if
+	// it does, that user is now the one to find.
+	for id, other := range dbStructure.Users {
+		if other.Email == user.Email {
+			dbStructure.indexes.userIdByEmail[user.Email] = id
+			break
+		}
+	}
+}
+
+// userByEmail looks a user up through the email index.
+func (dbStructure *DBStructure) userByEmail(email string) (DBUser, bool) {
+	userId, ok := dbStructure.indexes.userIdByEmail[email]
+	if !ok {
+		return DBUser{}, false
+	}
+	user, ok := dbStructure.Users[userId]
+	return user, ok
+}
+
+// chirpsById resolves an ascending list of ids into chirps.
+func (dbStructure *DBStructure) chirpsById(ids []string) []Chirp {
+	chirps := make([]Chirp, 0, len(ids))
+	for _, id := range ids {
+		chirps = append(chirps, dbStructure.Chirps[id])
+	}
+	return chirps
+}
+
+// comparePositions orders chirps by the time they were created, then by id.
+// Ids alone don't follow creation order for imported chirps.
+func comparePositions(aCreatedAt time.Time, aId string, bCreatedAt time.Time, bId string) int {
+	if c := aCreatedAt.Compare(bCreatedAt); c != 0 {
+		return c
+	}
+	return compareIds(aId, bId)
+}
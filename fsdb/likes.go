@@ -0,0 +1,166 @@
+package fsdb
+
+import (
+	"slices"
+	"time"
+)
+
+// Like records that a user liked a chirp.
+type Like struct {
+	ChirpId string    `json:"chirp_id"`
+	UserId  string    `json:"user_id"`
+	LikedAt time.Time `json:"liked_at"`
+}
+
+// LikeChirp adds a like by userId to the live chirp with chirpId and returns
+// the chirp with its new count. Liking a chirp twice changes nothing.
+func (tx *Tx) LikeChirp(chirpId, userId string) (Chirp, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return Chirp{}, writableErr
+	}
+	return tx.b.likeChirp(chirpId, userId)
+}
+
+// UnlikeChirp takes back a like by userId. Chirps the user doesn't like are
+// left alone.
+func (tx *Tx) UnlikeChirp(chirpId, userId string) (Chirp, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return Chirp{}, writableErr
+	}
+	return tx.b.unlikeChirp(chirpId, userId)
+}
+
+// GetChirpLikes lists who liked a live chirp, earliest like first.
+func (tx *Tx) GetChirpLikes(chirpId string) ([]Like, error) {
+	return tx.b.getChirpLikes(chirpId)
+}
+
+func (s txStore) LikeChirp(chirpId, userId string) (Chirp, error) {
+	var chirp Chirp
+	err := s.runner.Update(func(tx *Tx) error {
+		var likeErr error
+		chirp, likeErr = tx.LikeChirp(chirpId, userId)
+		return likeErr
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (s txStore) UnlikeChirp(chirpId, userId string) (Chirp, error) {
+	var chirp Chirp
+	err := s.runner.Update(func(tx *Tx) error {
+		var unlikeErr error
+		chirp, unlikeErr = tx.UnlikeChirp(chirpId, userId)
+		return unlikeErr
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (s txStore) GetChirpLikes(chirpId string) ([]Like, error) {
+	var likes []Like
+	err := s.runner.View(func(tx *Tx) error {
+		var getErr error
+		likes, getErr = tx.GetChirpLikes(chirpId)
+		return getErr
+	})
+	return likes, err
+}
+
+// setLike stores a like and counts it on its chirp. Storing a like again
+// only updates its time.
+func (dbStructure *DBStructure) setLike(like Like) {
+	likes, ok := dbStructure.Likes[like.ChirpId]
+	if !ok {
+		likes = make(map[string]time.Time)
+		dbStructure.Likes[like.ChirpId] = likes
+	}
+	likes[like.UserId] = like.LikedAt
+	idx := dbStructure.indexes
+	idx.chirpsLikedBy[like.UserId] = insertSorted(idx.chirpsLikedBy[like.UserId], like.ChirpId, idx.compareChirps)
+	dbStructure.countLikes(like.ChirpId)
+}
+
+func (dbStructure *DBStructure) removeLike(chirpId, userId string) {
+	likes := dbStructure.Likes[chirpId]
+	if _, ok := likes[userId]; !ok {
+		return
+	}
+	delete(likes, userId)
+	if len(likes) == 0 {
+		delete(dbStructure.Likes, chirpId)
+	}
+	removeFromIndex(dbStructure.indexes.chirpsLikedBy, userId, chirpId, dbStructure.indexes.compareChirps)
+	dbStructure.countLikes(chirpId)
+}
+
+// countLikes brings the like count stored on a chirp up to date.
+func (dbStructure *DBStructure) countLikes(chirpId string) {
+	if chirp, ok := dbStructure.Chirps[chirpId]; ok {
+		chirp.LikeCount = len(dbStructure.Likes[chirpId])
+		dbStructure.Chirps[chirpId] = chirp
+	}
+}
+
+func (b *batch) likeChirp(chirpId, userId string) (Chirp, error) {
+	if _, getErr := b.getUniqueChirp(chirpId); getErr != nil {
+		return Chirp{}, getErr
+	}
+	if _, ok := b.Users[userId]; !ok {
+		return Chirp{}, ErrUserNotFound
+	}
+	if _, liked := b.Likes[chirpId][userId]; !liked {
+		b.putLike(opChirpLiked, Like{ChirpId: chirpId, UserId: userId, LikedAt: b.now})
+	}
+	return b.Chirps[chirpId], nil
+}
+
+func (b *batch) unlikeChirp(chirpId, userId string) (Chirp, error) {
+	if _, getErr := b.getUniqueChirp(chirpId); getErr != nil {
+		return Chirp{}, getErr
+	}
+	if likedAt, liked := b.Likes[chirpId][userId]; liked {
+		b.putLike(opChirpUnliked, Like{ChirpId: chirpId, UserId: userId, LikedAt: likedAt})
+	}
+	return b.Chirps[chirpId], nil
+}
+
+// unlikeAll takes back every like of a chirp.
+func (b *batch) unlikeAll(chirpId string) {
+	for _, like := range b.likesOf(chirpId) {
+		b.putLike(opChirpUnliked, like)
+	}
+}
+
+// unlikeAllBy takes back every like a user gave.
+func (b *batch) unlikeAllBy(userId string) {
+	for _, chirpId := range slices.Clone(b.indexes.chirpsLikedBy[userId]) {
+		b.putLike(opChirpUnliked, Like{ChirpId: chirpId, UserId: userId, LikedAt: b.Likes[chirpId][userId]})
+	}
+}
+
+func (dbStructure *DBStructure) getChirpLikes(chirpId string) ([]Like, error) {
+	if _, getErr := dbStructure.getUniqueChirp(chirpId); getErr != nil {
+		return nil, getErr
+	}
+	return dbStructure.likesOf(chirpId), nil
+}
+
+// likesOf lists the likes of a chirp, earliest first.
+func (dbStructure *DBStructure) likesOf(chirpId string) []Like {
+	likes := []Like{}
+	for userId, likedAt := range dbStructure.Likes[chirpId] {
+		likes = append(likes, Like{ChirpId: chirpId, UserId: userId, LikedAt: likedAt})
+	}
+	slices.SortFunc(likes, func(a, b Like) int {
+		if c := a.LikedAt.Compare(b.LikedAt); c != 0 {
+			return c
+		}
+		return compareIds(a.UserId, b.UserId)
+	})
+	return likes
+}
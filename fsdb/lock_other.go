@@ -0,0 +1,22 @@
+//go:build !unix
+
+package fsdb
+
+import (
+	"errors"
+	"os"
+)
+
+// acquireLock only creates the lock file on platforms without flock, so
+// nothing stops two processes from opening the same database there.
+func acquireLock(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+}
+
+func acquireSharedLock(path string) (*os.File, error) {
+	file, openErr := os.Open(path)
+	if errors.Is(openErr, os.ErrNotExist) {
+		return nil, nil
+	}
+	return file, openErr
+}
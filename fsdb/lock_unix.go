@@ -0,0 +1,46 @@
+//go:build unix
+
+package fsdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// acquireLock takes an exclusive advisory lock on the file at path, creating
+// it if needed. The lock is held until the returned file is closed, and is
+// released by the kernel if the process dies.
+func acquireLock(path string) (*os.File, error) {
+	file, openErr := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if openErr != nil {
+		return nil, openErr
+	}
+	return lockFile(file, syscall.LOCK_EX)
+}
+
+// acquireSharedLock takes a shared lock on the file at path, which keeps
+// others from taking the exclusive one. A missing file isn't created, as
+// nobody can hold a lock on it; the returned file is nil then.
+func acquireSharedLock(path string) (*os.File, error) {
+	file, openErr := os.Open(path)
+	if errors.Is(openErr, os.ErrNotExist) {
+		return nil, nil
+	}
+	if openErr != nil {
+		return nil, openErr
+	}
+	return lockFile(file, syscall.LOCK_SH)
+}
+
+func lockFile(file *os.File, how int) (*os.File, error) {
+	if lockErr := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); lockErr != nil {
+		file.Close()
+		if errors.Is(lockErr, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%s: %w", file.Name(), ErrLocked)
+		}
+		return nil, lockErr
+	}
+	return file, nil
+}
@@ -0,0 +1,48 @@
+package fsdb
+
+import "sync"
+
+// MemDB is a Store that never touches the filesystem. All data is lost when
+// the process exits, which makes it suitable for tests and throwaway instances.
+type MemDB struct {
+	mu          *sync.RWMutex
+	dbStructure DBStructure
+	txStore
+	*feed
+}
+
+func (db *MemDB) View(fn func(tx *Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fn(&Tx{b: newBatch(&db.dbStructure)})
+}
+
+func (db *MemDB) Update(fn func(tx *Tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b := newBatch(&db.dbStructure)
+	committed := false
+	defer func() {
+		if !committed {
+			b.rollback()
+		}
+	}()
+	if fnErr := fn(&Tx{b: b, writable: true}); fnErr != nil {
+		return fnErr
+	}
+	changes := db.feed.prepare(b)
+	committed = true
+	db.feed.publish(changes)
+	return nil
+}
+
+func (db *MemDB) Close() error {
+	db.feed.closeAll()
+	return nil
+}
+
+func NewMemDB() *MemDB {
+	db := &MemDB{mu: &sync.RWMutex{}, dbStructure: newDBStructure(), feed: newFeed(0)}
+	db.txStore = txStore{db}
+	return db
+}
@@ -0,0 +1,307 @@
+package fsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schemaVersionKey is the metadata key holding the schema version a file was
+// written with. Files from before versioning existed don't have it and are
+// treated as version 0.
+const schemaVersionKey = "schemaVersion"
+
+// A migration upgrades a decoded database document from version-1 to
+// version. It works on the generic JSON representation so it doesn't depend
+// on the current shape of DBStructure. If the change affects the entities
+// carried by journal records and export lines, migrateRecord upgrades one of
+// those; as they don't say which version wrote them, it must leave records
+// that are already upgraded alone.
+type migration struct {
+	version       int
+	description   string
+	migrate       func(doc map[string]any) error
+	migrateRecord func(rec map[string]any) error
+}
+
+// migrations must be kept in ascending version order without gaps. Append
+// to it whenever a change to the stored types needs existing files upgraded.
+var migrations = []migration{
+	{1, "add schema version to metadata", func(doc map[string]any) error { return nil }, nil},
+	{2, "key revoked tokens by hash and track their expiry", migrateRevokedTokenHashes, nil},
+	{3, "add created and updated timestamps to chirps and users", migrateTimestamps, nil},
+	// Older versions would show soft-deleted chirps as live ones.
+	{4, "allow soft-deleted chirps", func(doc map[string]any) error { return nil }, nil},
+	// Older versions would keep a stale checksum when rewriting the file.
+	{5, "add checksum to metadata", func(doc map[string]any) error { return nil }, nil},
+	{6, "store ids as strings", migrateStringIds, migrateRecordStringIds},
+	{7, "extract hashtags and mentions from chirps", migrateEntities, migrateRecordEntities},
+	// Older versions would drop the links between replies when rewriting
+	// the file.
+	{8, "allow replies", func(doc map[string]any) error { return nil }, nil},
+	// Older versions would drop likes when rewriting the file.
+	{9, "add likes", func(doc map[string]any) error { return nil }, nil},
+	// Existing users are left without a handle until they choose one, as
+	// the part of their email before the @ isn't theirs to publish. Their
+	// mentions were resolved to user ids by version 7 and still work.
+	{10, "give users handles", func(doc map[string]any) error { return nil }, nil},
+}
+
+// legacyRefreshTokenLifetime bounds the remaining lifetime of a token that was
+// revoked before expiries were tracked: refresh tokens are issued for 60 days
+// and can't be revoked before they are issued.
+const legacyRefreshTokenLifetime = 60 * 24 * time.Hour
+
+func migrateRevokedTokenHashes(doc map[string]any) error {
+	revokedTokens, _ := doc["revoked-tokens"].(map[string]any)
+	migrated := make(map[string]any, len(revokedTokens))
+	for token, rawRevokedAt := range revokedTokens {
+		revokedAtString, _ := rawRevokedAt.(string)
+		revokedAt, parseErr := time.Parse(time.RFC3339Nano, revokedAtString)
+		if parseErr != nil {
+			return parseErr
+		}
+		migrated[revokedTokenKey(token)] = revokedAt.Add(legacyRefreshTokenLifetime).Format(time.RFC3339Nano)
+	}
+	doc["revoked-tokens"] = migrated
+	return nil
+}
+
+// migrateTimestamps backfills created_at and updated_at. When the rows were
+// really created is unknown, so they all get the time of the migration; id
+// order still tells them apart.
+func migrateTimestamps(doc map[string]any) error {
+	migratedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, collection := range []string{"chirps", "users"} {
+		rows, _ := doc[collection].(map[string]any)
+		for _, rawRow := range rows {
+			row, ok := rawRow.(map[string]any)
+			if !ok {
+				return fmt.Errorf("invalid entry in %s", collection)
+			}
+			if _, ok := row["created_at"]; !ok {
+				row["created_at"] = migratedAt
+			}
+			if _, ok := row["updated_at"]; !ok {
+				row["updated_at"] = row["created_at"]
+			}
+		}
+	}
+	return nil
+}
+
+// migrateStringIds turns numeric ids into strings holding the same number, so
+// existing ids, and links and tokens containing them, keep working.
+func migrateStringIds(doc map[string]any) error {
+	for collection, fields := range map[string][]string{"chirps": {"id", "author_id"}, "users": {"id"}} {
+		rows, _ := doc[collection].(map[string]any)
+		for _, rawRow := range rows {
+			row, ok := rawRow.(map[string]any)
+			if !ok {
+				return fmt.Errorf("invalid entry in %s", collection)
+			}
+			stringifyIds(row, fields...)
+		}
+	}
+	return nil
+}
+
+func migrateRecordStringIds(rec map[string]any) error {
+	if chirp, ok := rec["chirp"].(map[string]any); ok {
+		stringifyIds(chirp, "id", "author_id")
+	}
+	if user, ok := rec["user"].(map[string]any); ok {
+		stringifyIds(user, "id")
+	}
+	return nil
+}
+
+func stringifyIds(row map[string]any, fields ...string) {
+	for _, field := range fields {
+		if number, ok := row[field].(json.Number); ok {
+			row[field] = number.String()
+		}
+	}
+}
+
+// emailHandle returns the part of an email before the @ in lower case,
+// which older versions mentioned users by.
+func emailHandle(email string) string {
+	local, _, _ := strings.Cut(email, "@")
+	return strings.ToLower(local)
+}
+
+// migrateEntities extracts the hashtags and mentions of existing chirps,
+// resolving mentions against the users in the file.
+func migrateEntities(doc map[string]any) error {
+	users, _ := doc["users"].(map[string]any)
+	userIdsByHandle := make(map[string][]string, len(users))
+	for id, rawUser := range users {
+		user, ok := rawUser.(map[string]any)
+		if !ok {
+			return fmt.Errorf("invalid entry in users")
+		}
+		email, _ := user["email"].(string)
+		userIdsByHandle[emailHandle(email)] = append(userIdsByHandle[emailHandle(email)], id)
+	}
+	resolve := func(handle string) (string, bool) {
+		if ids := userIdsByHandle[handle]; len(ids) == 1 {
+			return ids[0], true
+		}
+		return "", false
+	}
+	chirps, _ := doc["chirps"].(map[string]any)
+	for _, rawChirp := range chirps {
+		chirp, ok := rawChirp.(map[string]any)
+		if !ok {
+			return fmt.Errorf("invalid entry in chirps")
+		}
+		setEntities(chirp, resolve)
+	}
+	return nil
+}
+
+// migrateRecordEntities extracts the hashtags of chirps in old records. Who
+// they mention is unknown without the users, so they don't mention anyone.
+func migrateRecordEntities(rec map[string]any) error {
+	chirp, ok := rec["chirp"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	_, hasHashtags := chirp["hashtags"]
+	_, hasMentions := chirp["mentions"]
+	if !hasHashtags && !hasMentions {
+		setEntities(chirp, func(string) (string, bool) { return "", false })
+	}
+	return nil
+}
+
+func setEntities(chirp map[string]any, resolve func(handle string) (string, bool)) {
+	body, _ := chirp["body"].(string)
+	hashtags, mentions := parseEntities(body, resolve)
+	if len(hashtags) > 0 {
+		chirp["hashtags"] = hashtags
+	}
+	if len(mentions) > 0 {
+		chirp["mentions"] = mentions
+	}
+}
+
+// upgradeRecord applies every record migration to a journal record or an
+// export line.
+func upgradeRecord(dat []byte) ([]byte, error) {
+	rec := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(dat))
+	decoder.UseNumber()
+	if decodeErr := decoder.Decode(&rec); decodeErr != nil {
+		return nil, decodeErr
+	}
+	for _, m := range migrations {
+		if m.migrateRecord == nil {
+			continue
+		}
+		if migrateErr := m.migrateRecord(rec); migrateErr != nil {
+			return nil, fmt.Errorf("migration to schema version %d failed: %w", m.version, migrateErr)
+		}
+	}
+	return json.Marshal(rec)
+}
+
+// SchemaVersion is the schema version written by this version of fsdb.
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// SchemaVersionError is returned when a database file was written by a newer
+// version of fsdb than the running one.
+type SchemaVersionError struct {
+	Path      string
+	Version   int
+	Supported int
+}
+
+func (e *SchemaVersionError) Error() string {
+	return fmt.Sprintf("database %s has schema version %d, but only versions up to %d are supported", e.Path, e.Version, e.Supported)
+}
+
+// MigrationReport describes the migrations Open applied to a database file.
+type MigrationReport struct {
+	From int
+	To   int
+	// BackupPath holds the file as it was before migrating.
+	BackupPath string
+	Applied    []string
+}
+
+func (report *MigrationReport) String() string {
+	return fmt.Sprintf("migrated database from schema version %d to %d (backup at %s)", report.From, report.To, report.BackupPath)
+}
+
+func metadataMap(doc map[string]any) map[string]any {
+	metadata, ok := doc["metadata"].(map[string]any)
+	if !ok {
+		metadata = map[string]any{}
+		doc["metadata"] = metadata
+	}
+	return metadata
+}
+
+func documentVersion(doc map[string]any) (int, error) {
+	rawVersion, ok := metadataMap(doc)[schemaVersionKey]
+	if !ok {
+		return 0, nil
+	}
+	versionString, ok := rawVersion.(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid schema version %v", rawVersion)
+	}
+	return strconv.Atoi(versionString)
+}
+
+// decodeDocument turns the contents of a database file into a DBStructure,
+// migrating it to the current schema version first if necessary. It returns
+// the version the file was written with along with the descriptions of the
+// migrations that were applied. With verify set, a document of the current
+// version must match its checksum.
+func decodeDocument(path string, dat []byte, verify bool) (DBStructure, int, []string, error) {
+	doc := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(dat))
+	decoder.UseNumber()
+	if decodeErr := decoder.Decode(&doc); decodeErr != nil {
+		return DBStructure{}, 0, nil, decodeErr
+	}
+	fromVersion, versionErr := documentVersion(doc)
+	if versionErr != nil {
+		return DBStructure{}, 0, nil, versionErr
+	}
+	if fromVersion > SchemaVersion {
+		return DBStructure{}, 0, nil, &SchemaVersionError{path, fromVersion, SchemaVersion}
+	}
+
+	dbStructure := DBStructure{}
+	if fromVersion == SchemaVersion {
+		if unmarshalErr := json.Unmarshal(dat, &dbStructure); unmarshalErr != nil {
+			return DBStructure{}, 0, nil, unmarshalErr
+		}
+		if verify {
+			if checksumErr := verifyChecksum(path, dbStructure); checksumErr != nil {
+				return DBStructure{}, 0, nil, checksumErr
+			}
+		}
+		return dbStructure, fromVersion, nil, nil
+	}
+	applied := []string{}
+	for _, m := range migrations[fromVersion:] {
+		if migrateErr := m.migrate(doc); migrateErr != nil {
+			return DBStructure{}, 0, nil, fmt.Errorf("migration to schema version %d failed: %w", m.version, migrateErr)
+		}
+		metadataMap(doc)[schemaVersionKey] = strconv.Itoa(m.version)
+		applied = append(applied, m.description)
+	}
+	migrated, marshalErr := json.Marshal(doc)
+	if marshalErr != nil {
+		return DBStructure{}, 0, nil, marshalErr
+	}
+	return dbStructure, fromVersion, applied, json.Unmarshal(migrated, &dbStructure)
+}
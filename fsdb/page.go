@@ -0,0 +1,112 @@
+package fsdb
+
+import (
+	"slices"
+	"time"
+)
+
+// ChirpQuery selects a range of live chirps in the order they were created
+// in, with chirps created at the same time ordered by id. Reading the next
+// range after the last chirp of the previous one neither repeats nor skips
+// chirps when others are created or deleted in between.
+type ChirpQuery struct {
+	// AuthorId, Hashtag, MentionedUserId and LikedByUserId restrict the
+	// range to the chirps of one author, with a hashtag, mentioning a user,
+	// or liked by a user. Hashtags are matched ignoring case, with or without
+	// their #.
+	AuthorId        string
+	Hashtag         string
+	MentionedUserId string
+	LikedByUserId   string
+	// After and AfterCreatedAt start the range behind the chirp with this
+	// id and creation time, which may have been deleted since. An empty
+	// After starts at the first chirp.
+	After          string
+	AfterCreatedAt time.Time
+	// Descending lists the newest chirps first; After then skips the newer
+	// ones.
+	Descending bool
+	// Since and Until skip chirps created before Since or at Until and later.
+	// Zero times don't skip anything.
+	Since time.Time
+	Until time.Time
+	// Limit caps the number of chirps; zero means no limit.
+	Limit int
+}
+
+// ChirpPage is one range of chirps. More reports whether further chirps
+// match the query behind the last one.
+type ChirpPage struct {
+	Chirps []Chirp
+	More   bool
+}
+
+// GetChirpPage reads a range of chirps without copying the others.
+func (tx *Tx) GetChirpPage(query ChirpQuery) (ChirpPage, error) {
+	return tx.b.getChirpPage(query), nil
+}
+
+func (s txStore) GetChirpPage(query ChirpQuery) (ChirpPage, error) {
+	var page ChirpPage
+	err := s.runner.View(func(tx *Tx) error {
+		var getErr error
+		page, getErr = tx.GetChirpPage(query)
+		return getErr
+	})
+	return page, err
+}
+
+func (dbStructure *DBStructure) getChirpPage(query ChirpQuery) ChirpPage {
+	ids := dbStructure.indexes.chirpIds
+	filtered := false
+	for _, filter := range []struct {
+		index map[string][]string
+		key   string
+	}{
+		{dbStructure.indexes.chirpsByAuthor, query.AuthorId},
+		{dbStructure.indexes.chirpsByHashtag, normalizeHashtag(query.Hashtag)},
+		{dbStructure.indexes.chirpsByMention, query.MentionedUserId},
+		{dbStructure.indexes.chirpsLikedBy, query.LikedByUserId},
+	} {
+		if filter.key == "" {
+			continue
+		}
+		if filtered {
+			ids = intersectIds(ids, filter.index[filter.key], dbStructure.indexes.compareChirps)
+		} else {
+			ids, filtered = filter.index[filter.key], true
+		}
+	}
+
+	start, step := 0, 1
+	if query.Descending {
+		start, step = len(ids)-1, -1
+	}
+	if query.After != "" {
+		pos, found := slices.BinarySearchFunc(ids, query.After, func(id, after string) int {
+			return comparePositions(dbStructure.Chirps[id].CreatedAt, id, query.AfterCreatedAt, after)
+		})
+		switch {
+		case query.Descending:
+			start = pos - 1
+		case found:
+			start = pos + 1
+		default:
+			start = pos
+		}
+	}
+
+	var page ChirpPage
+	for i := start; i >= 0 && i < len(ids); i += step {
+		chirp := dbStructure.Chirps[ids[i]]
+		if (!query.Since.IsZero() && chirp.CreatedAt.Before(query.Since)) || (!query.Until.IsZero() && !chirp.CreatedAt.Before(query.Until)) {
+			continue
+		}
+		if query.Limit > 0 && len(page.Chirps) == query.Limit {
+			page.More = true
+			break
+		}
+		page.Chirps = append(page.Chirps, chirp)
+	}
+	return page
+}
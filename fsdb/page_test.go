@@ -0,0 +1,77 @@
+package fsdb
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// importChirpsOutOfIdOrder creates chirps whose ids don't follow the order
+// they were created in, as an import keeping ids can.
+func importChirpsOutOfIdOrder(t *testing.T) *MemDB {
+	t.Helper()
+	export := strings.Join([]string{
+		`{"type":"user","user":{"id":"1","email":"a@x.com","password":"x","created_at":"2024-01-01T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"1","author_id":"1","body":"third","created_at":"2024-01-03T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"2","author_id":"1","body":"first","created_at":"2024-01-01T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"3","author_id":"1","body":"second","created_at":"2024-01-02T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"4","author_id":"1","body":"also first","created_at":"2024-01-01T00:00:00Z"}}`,
+	}, "\n")
+	db := NewMemDB()
+	if _, importErr := Import(db, strings.NewReader(export), ImportOptions{KeepIds: true}); importErr != nil {
+		t.Fatal(importErr)
+	}
+	return db
+}
+
+// readPages follows a query a chirp at a time and returns the bodies read.
+func readPages(t *testing.T, db Store, query ChirpQuery, between func(last Chirp)) []string {
+	t.Helper()
+	query.Limit = 1
+	bodies := []string{}
+	for {
+		page, getErr := db.GetChirpPage(query)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		for _, chirp := range page.Chirps {
+			bodies = append(bodies, chirp.Body)
+		}
+		if !page.More {
+			return bodies
+		}
+		last := page.Chirps[len(page.Chirps)-1]
+		query.After, query.AfterCreatedAt = last.Id, last.CreatedAt
+		if between != nil {
+			between(last)
+		}
+	}
+}
+
+func TestChirpPagesFollowCreationOrder(t *testing.T) {
+	db := importChirpsOutOfIdOrder(t)
+	want := []string{"first", "also first", "second", "third"}
+
+	if got := readPages(t, db, ChirpQuery{}, nil); !slices.Equal(got, want) {
+		t.Errorf("ascending: got %v, want %v", got, want)
+	}
+	if got := readPages(t, db, ChirpQuery{AuthorId: "1"}, nil); !slices.Equal(got, want) {
+		t.Errorf("by author: got %v, want %v", got, want)
+	}
+	slices.Reverse(want)
+	if got := readPages(t, db, ChirpQuery{Descending: true}, nil); !slices.Equal(got, want) {
+		t.Errorf("descending: got %v, want %v", got, want)
+	}
+}
+
+func TestChirpPagesContinueAfterDeletedChirp(t *testing.T) {
+	db := importChirpsOutOfIdOrder(t)
+	got := readPages(t, db, ChirpQuery{}, func(last Chirp) {
+		if deleteErr := db.DeleteChirp(last.Id, last.AuthorId); deleteErr != nil {
+			t.Fatal(deleteErr)
+		}
+	})
+	if want := []string{"first", "also first", "second", "third"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
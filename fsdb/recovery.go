@@ -0,0 +1,107 @@
+package fsdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RecoveryReport describes what NewDB did to get a usable database after
+// finding the main file missing or unreadable.
+type RecoveryReport struct {
+	// Cause is the error encountered while reading the main file.
+	Cause error
+	// CorruptPath is where the unreadable file was moved for inspection.
+	// It is empty if the main file was missing altogether or the database
+	// was opened read-only.
+	CorruptPath string
+	// RestoredFrom is the backup the data was restored from.
+	RestoredFrom string
+}
+
+func (report *RecoveryReport) String() string {
+	if report.CorruptPath == "" {
+		return fmt.Sprintf("database file was unusable (%s), loaded %s instead", report.Cause, report.RestoredFrom)
+	}
+	return fmt.Sprintf("database file was unreadable (%s), moved it to %s and restored from %s", report.Cause, report.CorruptPath, report.RestoredFrom)
+}
+
+// openDBFile loads the database at path, creating an empty one if neither the
+// file nor its backup exist. If the file is missing or corrupt but a usable
+// backup is present, the backup is restored and described in the returned
+// recovery report. A file from a newer schema version is never treated as
+// corrupt, and neither is one failing its checksum if the options say to
+// ignore it. In read-only mode, a missing database is an error and the backup
+// is only loaded, not restored.
+func openDBFile(path string, options Options, s *sealer) (DBStructure, *RecoveryReport, *MigrationReport, error) {
+	readOnly := options.ReadOnly
+	dbStructure, migration, loadErr := readDBFile(path, s, !options.IgnoreChecksum)
+	if loadErr == nil {
+		return dbStructure, nil, migration, nil
+	}
+	if !isDamage(loadErr) {
+		return DBStructure{}, nil, nil, loadErr
+	}
+	_, backupStatErr := os.Stat(path + backupSuffix)
+	if errors.Is(loadErr, os.ErrNotExist) && errors.Is(backupStatErr, os.ErrNotExist) {
+		if readOnly {
+			return DBStructure{}, nil, nil, loadErr
+		}
+		dbStructure = newDBStructure()
+		dat, encodeErr := encodeDocument(dbStructure)
+		if encodeErr != nil {
+			return DBStructure{}, nil, nil, encodeErr
+		}
+		sealed, sealErr := s.seal(dat, snapshotContext)
+		if sealErr != nil {
+			return DBStructure{}, nil, nil, sealErr
+		}
+		return dbStructure, nil, nil, atomicWriteFile(path, sealed, false)
+	}
+
+	var backupStructure DBStructure
+	var backupMigration *MigrationReport
+	report, recoverErr := recoverFromBackup(path, loadErr, readOnly, func(backupPath string) error {
+		var backupErr error
+		backupStructure, backupMigration, backupErr = readDBFile(backupPath, s, true)
+		return backupErr
+	})
+	if recoverErr != nil {
+		return DBStructure{}, nil, nil, recoverErr
+	}
+	return backupStructure, report, backupMigration, nil
+}
+
+// isDamage tells whether loadErr means a file is missing or damaged, as
+// opposed to readable with the right software or key: neither a newer file
+// nor a missing or wrong key means the file is damaged.
+func isDamage(loadErr error) bool {
+	var versionErr *SchemaVersionError
+	return !errors.As(loadErr, &versionErr) && !errors.Is(loadErr, ErrEncrypted) && !errors.Is(loadErr, ErrWrongKey)
+}
+
+// recoverFromBackup falls back to the backup of path after reading path
+// failed with loadErr. readBackup must load the backup; unless readOnly is
+// set, the damaged file is then moved aside and replaced by a copy of it.
+func recoverFromBackup(path string, loadErr error, readOnly bool, readBackup func(backupPath string) error) (*RecoveryReport, error) {
+	backupPath := path + backupSuffix
+	if backupErr := readBackup(backupPath); backupErr != nil {
+		return nil, fmt.Errorf("database %s is unreadable (%w) and backup %s is unusable: %v", path, loadErr, backupPath, backupErr)
+	}
+	report := &RecoveryReport{Cause: loadErr, RestoredFrom: backupPath}
+	if readOnly {
+		return report, nil
+	}
+	if !errors.Is(loadErr, os.ErrNotExist) {
+		report.CorruptPath = fmt.Sprintf("%s%s%d", path, corruptSuffix, time.Now().Unix())
+		if renameErr := os.Rename(path, report.CorruptPath); renameErr != nil {
+			return nil, renameErr
+		}
+	}
+	if copyErr := copyFile(backupPath, path); copyErr != nil {
+		return nil, copyErr
+	}
+	return report, syncDir(filepath.Dir(path))
+}
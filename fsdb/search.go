@@ -0,0 +1,352 @@
+package fsdb
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SearchOrder decides how search results are ranked.
+type SearchOrder string
+
+const (
+	// ByRelevance ranks chirps by how well they match, using BM25; equally
+	// good matches are ranked newest first.
+	ByRelevance SearchOrder = "relevance"
+	// ByRecency ranks matching chirps newest first.
+	ByRecency SearchOrder = "recent"
+)
+
+// SearchQuery selects a page of chirps matching a full-text query.
+//
+// Text holds the terms every result must contain, in any order and ignoring
+// case and punctuation. A term ending in * matches every word starting with
+// it, and terms in double quotes must appear next to each other in that
+// order: `go "error handling" test*`.
+type SearchQuery struct {
+	Text     string
+	AuthorId string
+	Order    SearchOrder
+	// AfterId, AfterCreatedAt and, when ranking by relevance, AfterScore
+	// continue a search behind the last hit of the previous page.
+	AfterId        string
+	AfterCreatedAt time.Time
+	AfterScore     float64
+	// Stats, when ranking by relevance, are those of the previous page, so
+	// that chirps created or deleted in between don't change the scores.
+	// Zero stats are taken from the chirps as they are now.
+	Stats SearchStats
+	// Limit caps the number of hits; zero means no limit.
+	Limit int
+}
+
+// SearchHit is a chirp matching a search. Score is its relevance, which is
+// only comparable between hits of the same search.
+type SearchHit struct {
+	Chirp Chirp
+	Score float64
+}
+
+// SearchStats are the figures BM25 scores are computed from: how many live
+// chirps there are, how many words they hold together, and how many of them
+// each term of the query may occur in.
+type SearchStats struct {
+	ChirpCount int
+	WordCount  int
+	Matches    []int
+}
+
+// SearchPage is one page of search hits. More reports whether further hits
+// follow the last one. Stats are what the hits were scored with when ranking
+// by relevance.
+type SearchPage struct {
+	Hits  []SearchHit
+	More  bool
+	Stats SearchStats
+}
+
+// SearchChirps finds live chirps through the full-text index.
+func (tx *Tx) SearchChirps(query SearchQuery) (SearchPage, error) {
+	return tx.b.searchChirps(query)
+}
+
+func (s txStore) SearchChirps(query SearchQuery) (SearchPage, error) {
+	var page SearchPage
+	err := s.runner.View(func(tx *Tx) error {
+		var searchErr error
+		page, searchErr = tx.SearchChirps(query)
+		return searchErr
+	})
+	return page, err
+}
+
+// textIndex is an inverted index over the bodies of live chirps. postings
+// maps each word to the ids of the chirps containing it in the order of
+// compare; words lists the same words sorted, for prefix lookups.
+type textIndex struct {
+	postings map[string][]string
+	words    []string
+	compare  func(a, b string) int
+	// wordCount is the number of words in all indexed chirps, from which
+	// the average length BM25 normalizes by is derived.
+	wordCount int
+}
+
+func newTextIndex(compare func(a, b string) int) *textIndex {
+	return &textIndex{postings: make(map[string][]string), compare: compare}
+}
+
+// tokenize splits text into lowercase words. Anything that isn't a letter or
+// digit separates words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func (ti *textIndex) add(chirp Chirp) {
+	words := tokenize(chirp.Body)
+	ti.wordCount += len(words)
+	for _, word := range words {
+		ids, known := ti.postings[word]
+		if !known {
+			pos, _ := slices.BinarySearch(ti.words, word)
+			ti.words = slices.Insert(ti.words, pos, word)
+		}
+		ti.postings[word] = insertSorted(ids, chirp.Id, ti.compare)
+	}
+}
+
+func (ti *textIndex) remove(chirp Chirp) {
+	words := tokenize(chirp.Body)
+	ti.wordCount -= len(words)
+	for _, word := range words {
+		ids := removeSorted(ti.postings[word], chirp.Id, ti.compare)
+		if len(ids) > 0 {
+			ti.postings[word] = ids
+			continue
+		}
+		if _, known := ti.postings[word]; known {
+			delete(ti.postings, word)
+			if pos, found := slices.BinarySearch(ti.words, word); found {
+				ti.words = slices.Delete(ti.words, pos, pos+1)
+			}
+		}
+	}
+}
+
+// lookup returns the ids of the chirps containing word, or any word starting
+// with it if prefix is set.
+func (ti *textIndex) lookup(word string, prefix bool) []string {
+	if !prefix {
+		return ti.postings[word]
+	}
+	var ids []string
+	start, _ := slices.BinarySearch(ti.words, word)
+	for _, candidate := range ti.words[start:] {
+		if !strings.HasPrefix(candidate, word) {
+			break
+		}
+		ids = append(ids, ti.postings[candidate]...)
+	}
+	slices.SortFunc(ids, ti.compare)
+	return slices.Compact(ids)
+}
+
+// searchTerm is a word or quoted phrase of a query. With prefix set, its
+// last word matches any word starting with it.
+type searchTerm struct {
+	words  []string
+	prefix bool
+}
+
+func parseSearchText(text string) []searchTerm {
+	var terms []searchTerm
+	addTerm := func(raw string) {
+		words := tokenize(raw)
+		if len(words) > 0 {
+			terms = append(terms, searchTerm{words: words, prefix: strings.HasSuffix(raw, "*")})
+		}
+	}
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			addTerm(strings.TrimSpace(part))
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			addTerm(field)
+		}
+	}
+	return terms
+}
+
+// occurrences counts how often term appears in words.
+func (term searchTerm) occurrences(words []string) int {
+	count := 0
+	for start := 0; start+len(term.words) <= len(words); start++ {
+		if term.matchesAt(words, start) {
+			count++
+		}
+	}
+	return count
+}
+
+func (term searchTerm) matchesAt(words []string, start int) bool {
+	last := len(term.words) - 1
+	for i, word := range term.words {
+		if i == last && term.prefix {
+			return strings.HasPrefix(words[start+i], word)
+		}
+		if words[start+i] != word {
+			return false
+		}
+	}
+	return true
+}
+
+// intersectIds returns the ids in both a and b, which are sorted by
+// compare.
+func intersectIds(a, b []string, compare func(a, b string) int) []string {
+	var both []string
+	for len(a) > 0 && len(b) > 0 {
+		switch c := compare(a[0], b[0]); {
+		case c < 0:
+			a = a[1:]
+		case c > 0:
+			b = b[1:]
+		default:
+			both = append(both, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return both
+}
+
+func (dbStructure *DBStructure) searchChirps(query SearchQuery) (SearchPage, error) {
+	terms := parseSearchText(query.Text)
+	if len(terms) == 0 {
+		return SearchPage{}, ErrEmptySearch
+	}
+	if query.Order == "" {
+		query.Order = ByRelevance
+	}
+	if query.Order != ByRelevance && query.Order != ByRecency {
+		return SearchPage{}, ErrUnknownSearchOrder
+	}
+	ti := dbStructure.indexes.text
+
+	// Narrow the candidates down with the index before checking phrases and
+	// counting matches against the chirps themselves. For phrases, the index
+	// only knows which chirps contain all of their words.
+	termIds := make([][]string, len(terms))
+	for i, term := range terms {
+		last := len(term.words) - 1
+		for j, word := range term.words {
+			ids := ti.lookup(word, term.prefix && j == last)
+			if j == 0 {
+				termIds[i] = ids
+			} else {
+				termIds[i] = intersectIds(termIds[i], ids, ti.compare)
+			}
+		}
+	}
+	lookups := slices.Clone(termIds)
+	if query.AuthorId != "" {
+		lookups = append(lookups, dbStructure.indexes.chirpsByAuthor[query.AuthorId])
+	}
+	slices.SortFunc(lookups, func(a, b []string) int { return len(a) - len(b) })
+	candidates := lookups[0]
+	for _, ids := range lookups[1:] {
+		candidates = intersectIds(candidates, ids, ti.compare)
+	}
+
+	var hits []SearchHit
+	var frequencies [][]int
+	for _, id := range candidates {
+		chirp := dbStructure.Chirps[id]
+		words := tokenize(chirp.Body)
+		counts := make([]int, len(terms), len(terms)+1)
+		matched := true
+		for i, term := range terms {
+			if counts[i] = term.occurrences(words); counts[i] == 0 {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			hits = append(hits, SearchHit{Chirp: chirp})
+			frequencies = append(frequencies, append(counts, len(words)))
+		}
+	}
+
+	var stats SearchStats
+	if query.Order == ByRelevance {
+		stats = query.Stats
+		if stats.ChirpCount == 0 {
+			stats = dbStructure.searchStats(termIds)
+		} else if len(stats.Matches) != len(terms) {
+			return SearchPage{}, ErrSearchStatsMismatch
+		}
+		scoreHits(hits, frequencies, stats)
+	}
+	slices.SortFunc(hits, func(a, b SearchHit) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return comparePositions(b.Chirp.CreatedAt, b.Chirp.Id, a.Chirp.CreatedAt, a.Chirp.Id)
+	})
+
+	start := 0
+	if query.AfterId != "" {
+		start = len(hits)
+		for i, hit := range hits {
+			if hit.Score < query.AfterScore || (hit.Score == query.AfterScore && comparePositions(hit.Chirp.CreatedAt, hit.Chirp.Id, query.AfterCreatedAt, query.AfterId) < 0) {
+				start = i
+				break
+			}
+		}
+	}
+	page := SearchPage{Hits: hits[start:], Stats: stats}
+	if query.Limit > 0 && len(page.Hits) > query.Limit {
+		page.Hits, page.More = page.Hits[:query.Limit], true
+	}
+	return page, nil
+}
+
+// searchStats returns the current stats of a search whose terms may occur in
+// the chirps listed in termIds.
+func (dbStructure *DBStructure) searchStats(termIds [][]string) SearchStats {
+	stats := SearchStats{
+		ChirpCount: len(dbStructure.indexes.chirpIds),
+		WordCount:  dbStructure.indexes.text.wordCount,
+		Matches:    make([]int, len(termIds)),
+	}
+	for t, ids := range termIds {
+		stats.Matches[t] = len(ids)
+	}
+	return stats
+}
+
+// scoreHits ranks hits with BM25. frequencies holds, for every hit, how
+// often each term occurs in it followed by its length in words.
+func scoreHits(hits []SearchHit, frequencies [][]int, stats SearchStats) {
+	const k1, b = 1.2, 0.75
+	chirpCount := float64(stats.ChirpCount)
+	averageLength := float64(stats.WordCount) / max(chirpCount, 1)
+	for h := range hits {
+		length := float64(frequencies[h][len(stats.Matches)])
+		score := 0.0
+		for t, count := range stats.Matches {
+			matches := float64(count)
+			idf := math.Log(1 + (chirpCount-matches+0.5)/(matches+0.5))
+			tf := float64(frequencies[h][t])
+			score += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*length/averageLength))
+		}
+		hits[h].Score = score
+	}
+}
@@ -0,0 +1,120 @@
+package fsdb
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// importSearchableChirps imports chirps whose ids don't follow the order they
+// were created in.
+func importSearchableChirps(t *testing.T) *MemDB {
+	t.Helper()
+	export := strings.Join([]string{
+		`{"type":"user","user":{"id":"1","email":"a@x.com","password":"x","created_at":"2024-01-01T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"1","author_id":"1","body":"Error handling in Go","created_at":"2024-01-03T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"2","author_id":"1","body":"Go go go!","created_at":"2024-01-01T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"3","author_id":"1","body":"handling an error, in go","created_at":"2024-01-02T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"4","author_id":"1","body":"errors everywhere when learning go","created_at":"2024-01-01T00:00:00Z"}}`,
+	}, "\n")
+	db := NewMemDB()
+	if _, importErr := Import(db, strings.NewReader(export), ImportOptions{KeepIds: true}); importErr != nil {
+		t.Fatal(importErr)
+	}
+	return db
+}
+
+// searchPages follows a search a hit at a time and returns the bodies found.
+func searchPages(t *testing.T, db Store, query SearchQuery, between func()) []string {
+	t.Helper()
+	query.Limit = 1
+	bodies := []string{}
+	for {
+		page, searchErr := db.SearchChirps(query)
+		if searchErr != nil {
+			t.Fatal(searchErr)
+		}
+		for _, hit := range page.Hits {
+			bodies = append(bodies, hit.Chirp.Body)
+		}
+		if !page.More {
+			return bodies
+		}
+		if len(bodies) > 10 {
+			t.Fatalf("search doesn't end: %v", bodies)
+		}
+		last := page.Hits[len(page.Hits)-1]
+		query.AfterId, query.AfterCreatedAt, query.AfterScore = last.Chirp.Id, last.Chirp.CreatedAt, last.Score
+		query.Stats = page.Stats
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func TestSearchMatchesPhrasesAndPrefixes(t *testing.T) {
+	db := importSearchableChirps(t)
+	for _, test := range []struct {
+		text string
+		want []string
+	}{
+		{`"error handling"`, []string{"Error handling in Go"}},
+		{`"handling error"`, []string{}},
+		{`handling error`, []string{"Error handling in Go", "handling an error, in go"}},
+		{`error*`, []string{"Error handling in Go", "handling an error, in go", "errors everywhere when learning go"}},
+		{`"in go*"`, []string{"Error handling in Go", "handling an error, in go"}},
+		{`hand* "go go"`, []string{}},
+	} {
+		page, searchErr := db.SearchChirps(SearchQuery{Text: test.text, Order: ByRecency})
+		if searchErr != nil {
+			t.Fatal(searchErr)
+		}
+		got := []string{}
+		for _, hit := range page.Hits {
+			got = append(got, hit.Chirp.Body)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestSearchByRecencyFollowsCreationOrder(t *testing.T) {
+	db := importSearchableChirps(t)
+	want := []string{"Error handling in Go", "handling an error, in go", "errors everywhere when learning go", "Go go go!"}
+	if got := searchPages(t, db, SearchQuery{Text: "go", Order: ByRecency}, nil); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSearchPagesByRelevanceKeepTheirRanking(t *testing.T) {
+	db := importSearchableChirps(t)
+	page, searchErr := db.SearchChirps(SearchQuery{Text: "go"})
+	if searchErr != nil {
+		t.Fatal(searchErr)
+	}
+	want := []string{}
+	for _, hit := range page.Hits {
+		want = append(want, hit.Chirp.Body)
+	}
+	if want[0] != "Go go go!" {
+		t.Errorf("got %v, want the chirp saying go most often first", want)
+	}
+
+	// New chirps change every score, but not the pages of a search already
+	// under way.
+	between := func() {
+		if _, chirpErr := db.CreateChirp("nothing to see here, just a rather long chirp", "1"); chirpErr != nil {
+			t.Fatal(chirpErr)
+		}
+	}
+	if got := searchPages(t, db, SearchQuery{Text: "go"}, between); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	query := SearchQuery{Text: "go go", Stats: page.Stats}
+	if _, searchErr := db.SearchChirps(query); !errors.Is(searchErr, ErrSearchStatsMismatch) {
+		t.Errorf("stats of another search: got %v, want ErrSearchStatsMismatch", searchErr)
+	}
+}
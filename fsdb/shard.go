@@ -0,0 +1,473 @@
+package fsdb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Files of a sharded database. Chirps are kept in chirpsShard, or split into
+// segments: numeric ids by range, named after the first id of the range, and
+// other ids by their first segmentPrefixLength characters. For UUIDv7 ids,
+// that is a range of creation times about four and a half hours long.
+const (
+	metadataShard      = "metadata.json"
+	usersShard         = "users.json"
+	revokedTokensShard = "revoked-tokens.json"
+	likesShard         = "likes.json"
+	chirpsShard        = "chirps.json"
+	chirpSegmentPrefix = "chirps-"
+	shardExtension     = ".json"
+
+	segmentPrefixLength = 6
+)
+
+// shardLayout stores a database as a directory with a file per collection,
+// so a write only rewrites the files of the collections it changed. Each
+// file is a document of its own, with a schema version and a checksum in its
+// metadata; the metadata file holds the metadata of the whole database.
+//
+// Each file is replaced atomically, but a write touching several of them is
+// not: the metadata file is written last, and id counters left behind by a
+// crash are moved past the ids in use on open. With journaling, the journal
+// is replayed over the files instead, which makes every write atomic.
+type shardLayout struct {
+	dir string
+	// segmentSize is the number of chirp ids per segment file, or zero to
+	// keep all chirps in one file.
+	segmentSize int
+}
+
+// shardSet names the files of a sharded database that have to be written. A
+// nil set stands for all of them.
+type shardSet map[string]bool
+
+// add marks the files in other as changed too. A nil set already holds
+// everything and stays nil.
+func (set shardSet) add(other shardSet) shardSet {
+	if set == nil || other == nil {
+		return nil
+	}
+	for name := range other {
+		set[name] = true
+	}
+	return set
+}
+
+func (l *shardLayout) chirpShard(chirpId string) string {
+	if l.segmentSize <= 0 {
+		return chirpsShard
+	}
+	if n, ok := numericId(chirpId); ok {
+		firstId := (n-1)/l.segmentSize*l.segmentSize + 1
+		return fmt.Sprintf("%s%08d%s", chirpSegmentPrefix, firstId, shardExtension)
+	}
+	prefix := chirpId[:min(len(chirpId), segmentPrefixLength)]
+	if strings.Trim(prefix, "0123456789abcdef") != "" {
+		// Imported ids can be anything; keep them from naming other files.
+		prefix = "x" + hex.EncodeToString([]byte(prefix))
+	}
+	return chirpSegmentPrefix + prefix + shardExtension
+}
+
+func isChirpShard(name string) bool {
+	return name == chirpsShard || strings.HasPrefix(name, chirpSegmentPrefix) && strings.HasSuffix(name, shardExtension)
+}
+
+func isShard(name string) bool {
+	return name == metadataShard || name == usersShard || name == revokedTokensShard || name == likesShard || isChirpShard(name)
+}
+
+// touched returns the files holding the entities changed by records.
+func (l *shardLayout) touched(records []record) shardSet {
+	shards := shardSet{}
+	for _, rec := range records {
+		switch rec.Op {
+		case opChirpCreated, opChirpSoftDeleted, opChirpUndeleted, opChirpDeleted:
+			shards[l.chirpShard(rec.Chirp.Id)] = true
+		case opUserCreated, opUserUpdated, opUserUpgraded, opUserDeleted:
+			shards[usersShard] = true
+		case opChirpLiked, opChirpUnliked:
+			// The chirp carries the like count.
+			shards[likesShard] = true
+			shards[l.chirpShard(rec.Like.ChirpId)] = true
+		case opTokenRevoked, opTokenExpired:
+			shards[revokedTokensShard] = true
+		case opMetadataSet:
+			shards[metadataShard] = true
+		}
+	}
+	return shards
+}
+
+// files lists the paths of the files currently in the directory, or of
+// their backups if withBackups is set and the file itself is missing.
+func (l *shardLayout) files(withBackups bool) ([]string, error) {
+	entries, readErr := os.ReadDir(l.dir)
+	if readErr != nil {
+		return nil, readErr
+	}
+	names := map[string]bool{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if withBackups {
+			name = strings.TrimSuffix(name, backupSuffix)
+		}
+		if !entry.IsDir() && isShard(name) {
+			names[name] = true
+		}
+	}
+	paths := make([]string, 0, len(names))
+	for name := range names {
+		paths = append(paths, filepath.Join(l.dir, name))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// split divides dbStructure into the documents stored in the named files, or
+// in all files if shards is nil. Every document carries the schema version;
+// only the metadata file gets the rest of the metadata.
+func (l *shardLayout) split(dbStructure DBStructure, shards shardSet) map[string]DBStructure {
+	version := map[string]string{schemaVersionKey: strconv.Itoa(SchemaVersion)}
+	parts := map[string]DBStructure{}
+	if shards == nil || shards[metadataShard] {
+		parts[metadataShard] = DBStructure{Metadata: dbStructure.Metadata}
+	}
+	if shards == nil || shards[usersShard] {
+		parts[usersShard] = DBStructure{Users: dbStructure.Users, Metadata: version}
+	}
+	if shards == nil || shards[revokedTokensShard] {
+		parts[revokedTokensShard] = DBStructure{RevokedTokens: dbStructure.RevokedTokens, Metadata: version}
+	}
+	if shards == nil || shards[likesShard] {
+		parts[likesShard] = DBStructure{Likes: dbStructure.Likes, Metadata: version}
+	}
+	for name := range shards {
+		if isChirpShard(name) {
+			parts[name] = DBStructure{Chirps: map[string]Chirp{}, Metadata: version}
+		}
+	}
+	for id, chirp := range dbStructure.Chirps {
+		name := l.chirpShard(id)
+		if _, ok := parts[name]; !ok && shards == nil {
+			parts[name] = DBStructure{Chirps: map[string]Chirp{}, Metadata: version}
+		}
+		if part, ok := parts[name]; ok {
+			part.Chirps[id] = chirp
+		}
+	}
+	return parts
+}
+
+// encodeShard serializes one document returned by split. Only the collection
+// it holds is written, but the checksum covers the document as decoded, with
+// the other collections missing.
+func encodeShard(part DBStructure) ([]byte, error) {
+	sum, sumErr := computeChecksum(part)
+	if sumErr != nil {
+		return nil, sumErr
+	}
+	metadata := maps.Clone(part.Metadata)
+	metadata[checksumKey] = sum
+	doc := map[string]any{"metadata": metadata}
+	switch {
+	case part.Chirps != nil:
+		doc["chirps"] = part.Chirps
+	case part.Users != nil:
+		doc["users"] = part.Users
+	case part.RevokedTokens != nil:
+		doc["revoked-tokens"] = part.RevokedTokens
+	case part.Likes != nil:
+		doc["likes"] = part.Likes
+	}
+	return json.Marshal(doc)
+}
+
+// write stores the named files of dbStructure, or all of them if shards is
+// nil, in which case chirp files that are no longer needed are removed. The
+// metadata file is written last, so the id counters it holds never get ahead
+// of the entities written with them.
+func (l *shardLayout) write(dbStructure DBStructure, shards shardSet, s *sealer) error {
+	if mkdirErr := os.MkdirAll(l.dir, 0777); mkdirErr != nil {
+		return mkdirErr
+	}
+	parts := l.split(dbStructure, shards)
+	names := make([]string, 0, len(parts))
+	for name := range parts {
+		if name != metadataShard {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := parts[metadataShard]; ok {
+		names = append(names, metadataShard)
+	}
+	for _, name := range names {
+		dat, encodeErr := encodeShard(parts[name])
+		if encodeErr != nil {
+			return encodeErr
+		}
+		sealed, sealErr := s.seal(dat, shardContext(name))
+		if sealErr != nil {
+			return sealErr
+		}
+		if writeErr := atomicWriteFile(filepath.Join(l.dir, name), sealed, true); writeErr != nil {
+			return writeErr
+		}
+	}
+	if shards != nil {
+		return nil
+	}
+	// Chirps only live in the file their id belongs to, so leftovers from an
+	// emptied segment or another segment size are stale. Their backups go
+	// too, or recovery would bring them back.
+	paths, listErr := l.files(true)
+	if listErr != nil {
+		return listErr
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if _, ok := parts[name]; ok || !isChirpShard(name) {
+			continue
+		}
+		for _, stale := range []string{path, path + backupSuffix} {
+			if removeErr := os.Remove(stale); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+				return removeErr
+			}
+		}
+	}
+	return syncDir(l.dir)
+}
+
+// shard is the raw content of one file of a sharded database.
+type shard struct {
+	version     int
+	collections map[string]json.RawMessage
+}
+
+// readShard reads the file at path. Unless verify is false, a file of the
+// current schema version must match its checksum.
+func readShard(path string, s *sealer, verify bool) (shard, error) {
+	sealed, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return shard{}, readErr
+	}
+	dat, openErr := s.open(sealed, shardContext(path))
+	if openErr != nil {
+		return shard{}, fmt.Errorf("%s: %w", path, openErr)
+	}
+	collections := map[string]json.RawMessage{}
+	if unmarshalErr := json.Unmarshal(dat, &collections); unmarshalErr != nil {
+		return shard{}, unmarshalErr
+	}
+	metadata := map[string]string{}
+	if rawMetadata, ok := collections["metadata"]; ok {
+		if unmarshalErr := json.Unmarshal(rawMetadata, &metadata); unmarshalErr != nil {
+			return shard{}, unmarshalErr
+		}
+	}
+	version := 0
+	if versionString, ok := metadata[schemaVersionKey]; ok {
+		var atoiErr error
+		if version, atoiErr = strconv.Atoi(versionString); atoiErr != nil {
+			return shard{}, fmt.Errorf("invalid schema version %q", versionString)
+		}
+	}
+	if version > SchemaVersion {
+		return shard{}, &SchemaVersionError{path, version, SchemaVersion}
+	}
+	if version == SchemaVersion && verify {
+		dbStructure := DBStructure{}
+		if unmarshalErr := json.Unmarshal(dat, &dbStructure); unmarshalErr != nil {
+			return shard{}, unmarshalErr
+		}
+		if checksumErr := verifyChecksum(path, dbStructure); checksumErr != nil {
+			return shard{}, checksumErr
+		}
+	}
+	return shard{version: version, collections: collections}, nil
+}
+
+// openShard reads the file at path like openDBFile, restoring it from its
+// backup if it is damaged.
+func openShard(path string, options Options, s *sealer) (shard, *RecoveryReport, error) {
+	loaded, loadErr := readShard(path, s, !options.IgnoreChecksum)
+	if loadErr == nil || !isDamage(loadErr) {
+		return loaded, nil, loadErr
+	}
+	report, recoverErr := recoverFromBackup(path, loadErr, options.ReadOnly, func(backupPath string) error {
+		var backupErr error
+		loaded, backupErr = readShard(backupPath, s, true)
+		return backupErr
+	})
+	return loaded, report, recoverErr
+}
+
+// open loads a sharded database, creating an empty one if the directory
+// holds none. The files are merged into a single document before decoding,
+// so migrations see the whole database. rewrite is set if the files have to
+// be written again to match the layout, such as after changing the segment
+// size, or to save repairs made while loading.
+func (l *shardLayout) open(options Options, s *sealer) (dbStructure DBStructure, recovery *RecoveryReport, migration *MigrationReport, rewrite bool, err error) {
+	paths, listErr := l.files(true)
+	if errors.Is(listErr, os.ErrNotExist) && !options.ReadOnly {
+		paths, listErr = nil, nil
+	}
+	if listErr != nil {
+		return DBStructure{}, nil, nil, false, listErr
+	}
+	if len(paths) == 0 {
+		if options.ReadOnly {
+			return DBStructure{}, nil, nil, false, fmt.Errorf("%s: %w", l.dir, os.ErrNotExist)
+		}
+		return newDBStructure(), nil, nil, true, nil
+	}
+
+	doc := map[string]json.RawMessage{}
+	chirps := map[string]json.RawMessage{}
+	versions := []int{}
+	reports := []*RecoveryReport{}
+	for _, path := range paths {
+		loaded, report, openErr := openShard(path, options, s)
+		if openErr != nil {
+			return DBStructure{}, nil, nil, false, openErr
+		}
+		if report != nil {
+			reports = append(reports, report)
+		}
+		if !slices.Contains(versions, loaded.version) {
+			versions = append(versions, loaded.version)
+		}
+		name := filepath.Base(path)
+		if !isChirpShard(name) {
+			for key, raw := range loaded.collections {
+				if key == "metadata" && name != metadataShard {
+					continue
+				}
+				doc[key] = raw
+			}
+			continue
+		}
+		segment := map[string]json.RawMessage{}
+		if unmarshalErr := json.Unmarshal(loaded.collections["chirps"], &segment); unmarshalErr != nil {
+			return DBStructure{}, nil, nil, false, fmt.Errorf("%s: %w", path, unmarshalErr)
+		}
+		for id, raw := range segment {
+			chirps[id] = raw
+			rewrite = rewrite || l.chirpShard(id) != name
+		}
+	}
+	if len(versions) > 1 {
+		slices.Sort(versions)
+		return DBStructure{}, nil, nil, false, fmt.Errorf("database %s is partially migrated: its files have schema versions %v", l.dir, versions)
+	}
+	if _, ok := doc["metadata"]; !ok {
+		// The metadata file is gone but the data isn't; the id counters are
+		// rebuilt below.
+		doc["metadata"], _ = json.Marshal(map[string]string{schemaVersionKey: strconv.Itoa(versions[0])})
+	}
+	var marshalErr error
+	if doc["chirps"], marshalErr = json.Marshal(chirps); marshalErr != nil {
+		return DBStructure{}, nil, nil, false, marshalErr
+	}
+	dat, marshalErr := json.Marshal(doc)
+	if marshalErr != nil {
+		return DBStructure{}, nil, nil, false, marshalErr
+	}
+	dbStructure, fromVersion, applied, decodeErr := decodeDocument(l.dir, dat, false)
+	if decodeErr != nil {
+		return DBStructure{}, nil, nil, false, decodeErr
+	}
+	if len(applied) > 0 {
+		migration = &MigrationReport{From: fromVersion, To: SchemaVersion, Applied: applied}
+	}
+	if dbStructure.reconcileIdCounters() {
+		rewrite = true
+	}
+	return dbStructure, mergeRecoveryReports(reports), migration, rewrite, nil
+}
+
+// reconcileIdCounters moves the id counters past the highest ids in use, and
+// tells whether any of them had fallen behind.
+func (dbStructure *DBStructure) reconcileIdCounters() bool {
+	if dbStructure.Metadata == nil {
+		dbStructure.Metadata = map[string]string{}
+	}
+	changed := false
+	for key, maxId := range map[string]int{"nextChirpId": maxNumericId(dbStructure.Chirps), "nextUserId": maxNumericId(dbStructure.Users)} {
+		nextId, atoiErr := strconv.Atoi(dbStructure.Metadata[key])
+		if atoiErr == nil && nextId > maxId {
+			continue
+		}
+		dbStructure.Metadata[key] = strconv.Itoa(maxId + 1)
+		changed = true
+	}
+	return changed
+}
+
+// mergeRecoveryReports combines the reports of the files restored while
+// opening a sharded database into one.
+func mergeRecoveryReports(reports []*RecoveryReport) *RecoveryReport {
+	if len(reports) <= 1 {
+		if len(reports) == 0 {
+			return nil
+		}
+		return reports[0]
+	}
+	causes := []error{}
+	corruptPaths := []string{}
+	restoredFrom := []string{}
+	for _, report := range reports {
+		causes = append(causes, report.Cause)
+		if report.CorruptPath != "" {
+			corruptPaths = append(corruptPaths, report.CorruptPath)
+		}
+		restoredFrom = append(restoredFrom, report.RestoredFrom)
+	}
+	return &RecoveryReport{
+		Cause:        errors.Join(causes...),
+		CorruptPath:  strings.Join(corruptPaths, ", "),
+		RestoredFrom: strings.Join(restoredFrom, ", "),
+	}
+}
+
+// copyTo copies the files of the database into a new directory at dst.
+func (l *shardLayout) copyTo(dst string) error {
+	paths, listErr := l.files(false)
+	if listErr != nil {
+		return listErr
+	}
+	if mkdirErr := os.Mkdir(dst, 0777); mkdirErr != nil {
+		return mkdirErr
+	}
+	for _, path := range paths {
+		if copyErr := copyFile(path, filepath.Join(dst, filepath.Base(path))); copyErr != nil {
+			return copyErr
+		}
+	}
+	return syncDir(dst)
+}
+
+// verifyChecksums checks every file of the database against its checksum.
+func (l *shardLayout) verifyChecksums(s *sealer) error {
+	paths, listErr := l.files(false)
+	if listErr != nil {
+		return listErr
+	}
+	errs := []error{}
+	for _, path := range paths {
+		if _, readErr := readShard(path, s, true); readErr != nil {
+			errs = append(errs, readErr)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,80 @@
+package fsdb
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// chirpFiles lists the chirp files of the sharded database at path. It fails
+// the test if a backup of any other chirp file is left behind, as recovery
+// would bring that back.
+func chirpFiles(t *testing.T, path string) []string {
+	t.Helper()
+	entries, readErr := os.ReadDir(path)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if isChirpShard(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), backupSuffix); ok && isChirpShard(name) && !slices.Contains(names, name) {
+			t.Errorf("stale backup %s", entry.Name())
+		}
+	}
+	return names
+}
+
+func TestChangingChirpSegmentSizeRearrangesFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database")
+	db, openErr := Open(path, Options{Sharded: true})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	user, createErr := db.CreateUser("a@x.com", "x", "")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	bodies := []string{"one", "two", "three", "four", "five"}
+	for _, body := range bodies {
+		if _, chirpErr := db.CreateChirp(body, user.Id); chirpErr != nil {
+			t.Fatal(chirpErr)
+		}
+	}
+	db.Close()
+
+	for _, layout := range []struct {
+		segmentSize int
+		files       []string
+	}{
+		{2, []string{"chirps-00000001.json", "chirps-00000003.json", "chirps-00000005.json"}},
+		{3, []string{"chirps-00000001.json", "chirps-00000004.json"}},
+		{0, []string{"chirps.json"}},
+	} {
+		db, openErr := Open(path, Options{ChirpSegmentSize: layout.segmentSize})
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		chirps, getErr := db.GetChirps()
+		db.Close()
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		got := []string{}
+		for _, chirp := range chirps {
+			got = append(got, chirp.Body)
+		}
+		if !slices.Equal(got, bodies) {
+			t.Errorf("segment size %d: got chirps %v, want %v", layout.segmentSize, got, bodies)
+		}
+		if files := chirpFiles(t, path); !slices.Equal(files, layout.files) {
+			t.Errorf("segment size %d: got files %v, want %v", layout.segmentSize, files, layout.files)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package fsdb
+
+import (
+	"io"
+	"time"
+)
+
+// Store is the set of operations the server needs from its storage backend.
+// DB persists everything to a JSON file, MemDB keeps it in process memory.
+type Store interface {
+	View(fn func(tx *Tx) error) error
+	Update(fn func(tx *Tx) error) error
+
+	GetChirps() ([]Chirp, error)
+	GetChirpsFromAuthor(authorId string) ([]Chirp, error)
+	GetChirpPage(query ChirpQuery) (ChirpPage, error)
+	SearchChirps(query SearchQuery) (SearchPage, error)
+	GetUniqueChirp(chirpId string) (Chirp, error)
+	CreateChirp(body string, createdById string) (Chirp, error)
+	CreateReply(body string, createdById string, parentId string) (Chirp, error)
+	GetThread(chirpId string) (*ThreadNode, error)
+	DeleteChirp(chirpId, userId string) error
+	UndeleteChirp(chirpId, userId string, grace time.Duration) (Chirp, error)
+	GetDeletedChirps() ([]Chirp, error)
+	PurgeDeletedChirps(cutoff time.Time) (int, error)
+	LikeChirp(chirpId, userId string) (Chirp, error)
+	UnlikeChirp(chirpId, userId string) (Chirp, error)
+	GetChirpLikes(chirpId string) ([]Like, error)
+
+	CreateUser(email, password, handle string) (User, error)
+	AuthenticateUser(email string, password string) (User, error)
+	GetUser(userId string) (User, error)
+	UpdateUser(userId string, newEmail, newPassword, newHandle string) (User, error)
+	UpgradeUser(userId string) error
+
+	RevokeToken(token string, expiresAt time.Time) error
+	IsTokenRevoked(token string) error
+	PruneRevokedTokens(now time.Time) (int, error)
+	CountRevokedTokens() (int, error)
+
+	// Subscribe and SubscribeAfter deliver the changes committed to the
+	// store; see Change.
+	Subscribe(buffer int) *Subscription
+	SubscribeAfter(seq uint64, buffer int) (*Subscription, error)
+
+	// Restore replaces all data with a snapshot written by Tx.WriteSnapshot.
+	Restore(r io.Reader) error
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*MemDB)(nil)
+)
@@ -0,0 +1,267 @@
+package fsdb
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The methods below hold the query and mutation logic shared by every Store
+// implementation. Queries operate on a DBStructure, mutations on a batch
+// wrapping one. Both leave locking and persistence to the caller.
+
+func newDBStructure() DBStructure {
+	dbStructure := DBStructure{
+		Chirps:        make(map[string]Chirp),
+		Users:         make(map[string]DBUser),
+		RevokedTokens: make(map[string]time.Time),
+		Likes:         make(map[string]map[string]time.Time),
+		Metadata: map[string]string{
+			"nextChirpId":    "1",
+			"nextUserId":     "1",
+			schemaVersionKey: strconv.Itoa(SchemaVersion),
+		},
+	}
+	dbStructure.rebuildIndexes()
+	return dbStructure
+}
+
+// fillDefaults makes sure every collection of a freshly decoded structure is
+// usable, so files written by older versions don't cause nil map writes, and
+// builds the indexes.
+func (dbStructure *DBStructure) fillDefaults() {
+	defaults := newDBStructure()
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = defaults.Chirps
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = defaults.Users
+	}
+	if dbStructure.RevokedTokens == nil {
+		dbStructure.RevokedTokens = defaults.RevokedTokens
+	}
+	if dbStructure.Likes == nil {
+		dbStructure.Likes = defaults.Likes
+	}
+	if dbStructure.Metadata == nil {
+		dbStructure.Metadata = defaults.Metadata
+	}
+	dbStructure.rebuildIndexes()
+}
+
+func (dbStructure *DBStructure) getChirps() []Chirp {
+	return dbStructure.chirpsById(dbStructure.indexes.chirpIds)
+}
+
+func (dbStructure *DBStructure) getChirpsFromAuthor(authorId string) []Chirp {
+	return dbStructure.chirpsById(dbStructure.indexes.chirpsByAuthor[authorId])
+}
+
+func (dbStructure *DBStructure) getDeletedChirps() []Chirp {
+	return dbStructure.chirpsById(dbStructure.indexes.deletedChirpIds)
+}
+
+func (dbStructure *DBStructure) getUniqueChirp(chirpId string) (Chirp, error) {
+	chirp, ok := dbStructure.Chirps[chirpId]
+	if !ok || chirp.DeletedAt != nil {
+		return Chirp{}, ErrChirpNotFound
+	}
+	return chirp, nil
+}
+
+// takeNextId returns the id counter stored in the metadata under key and
+// advances it.
+func (b *batch) takeNextId(key string) (string, error) {
+	nextId, atoiErr := strconv.Atoi(b.Metadata[key])
+	if atoiErr != nil {
+		return "", atoiErr
+	}
+	b.setMetadata(key, fmt.Sprintf("%d", nextId+1))
+	return strconv.Itoa(nextId), nil
+}
+
+// reserveId advances the id counter stored under key past id, so an entity
+// stored under an id it didn't hand out can't collide with later ones. Ids
+// that aren't numbers can't collide with the counter.
+func (b *batch) reserveId(key string, id string) error {
+	nextId, atoiErr := strconv.Atoi(b.Metadata[key])
+	if atoiErr != nil {
+		return atoiErr
+	}
+	if n, ok := numericId(id); ok && n >= nextId {
+		b.setMetadata(key, fmt.Sprintf("%d", n+1))
+	}
+	return nil
+}
+
+// createChirp adds a chirp, replying to the chirp with parentId unless that
+// is empty.
+func (b *batch) createChirp(body string, createdById string, parentId string) (Chirp, error) {
+	newChirp := Chirp{AuthorId: createdById, Body: body, CreatedAt: b.now, UpdatedAt: b.now}
+	if parentId != "" {
+		parent, getErr := b.getUniqueChirp(parentId)
+		if getErr != nil {
+			return Chirp{}, ErrParentNotFound
+		}
+		newChirp.InReplyTo = parent.Id
+		newChirp.RootId = parent.threadRootId()
+	}
+	nextChirpId, idErr := b.newId("nextChirpId")
+	if idErr != nil {
+		return Chirp{}, idErr
+	}
+	newChirp.Id = nextChirpId
+	b.extractEntities(&newChirp)
+	b.putChirp(opChirpCreated, newChirp)
+	return newChirp, nil
+}
+
+func (b *batch) deleteChirp(chirpId, userId string) error {
+	chirp, getErr := b.getUniqueChirp(chirpId)
+	if getErr != nil {
+		return getErr
+	}
+	if chirp.AuthorId != userId {
+		return ErrNotChirpAuthor
+	}
+	// Likes don't survive deletion, so undeleting starts the count over.
+	b.unlikeAll(chirpId)
+	deletedAt := b.now
+	chirp.DeletedAt = &deletedAt
+	chirp.UpdatedAt = b.now
+	b.putChirp(opChirpSoftDeleted, chirp)
+	return nil
+}
+
+func (b *batch) undeleteChirp(chirpId, userId string, grace time.Duration) (Chirp, error) {
+	chirp, ok := b.Chirps[chirpId]
+	if !ok {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if chirp.AuthorId != userId {
+		return Chirp{}, ErrNotChirpAuthor
+	}
+	if chirp.DeletedAt == nil {
+		return Chirp{}, ErrChirpNotDeleted
+	}
+	if b.now.Sub(*chirp.DeletedAt) > grace {
+		return Chirp{}, ErrUndeleteExpired
+	}
+	chirp.DeletedAt = nil
+	chirp.UpdatedAt = b.now
+	b.putChirp(opChirpUndeleted, chirp)
+	return chirp, nil
+}
+
+// purgeDeletedChirps permanently removes chirps deleted before cutoff.
+func (b *batch) purgeDeletedChirps(cutoff time.Time) int {
+	// Purging edits the index being read, so collect the chirps first.
+	expired := []Chirp{}
+	for _, chirp := range b.getDeletedChirps() {
+		if chirp.DeletedAt.Before(cutoff) {
+			expired = append(expired, chirp)
+		}
+	}
+	for _, chirp := range expired {
+		b.putChirp(opChirpDeleted, chirp)
+	}
+	return len(expired)
+}
+
+func (b *batch) createUser(email, password, handle string) (User, error) {
+	if _, taken := b.userByEmail(email); taken {
+		return User{}, ErrEmailTaken
+	}
+	if handle != "" {
+		var handleErr error
+		if handle, handleErr = b.claimHandle("", handle); handleErr != nil {
+			return User{}, handleErr
+		}
+	}
+	nextUserId, idErr := b.newId("nextUserId")
+	if idErr != nil {
+		return User{}, idErr
+	}
+	newUser := DBUser{
+		User:     User{Id: nextUserId, Email: email, Handle: handle, CreatedAt: b.now, UpdatedAt: b.now},
+		Password: password,
+	}
+	b.putUser(opUserCreated, newUser)
+	return newUser.User, nil
+}
+
+// claimHandle normalizes handle and checks that no user but userId has it.
+func (dbStructure *DBStructure) claimHandle(userId, handle string) (string, error) {
+	handle, handleErr := normalizeHandle(handle)
+	if handleErr != nil {
+		return "", handleErr
+	}
+	if owner, taken := dbStructure.indexes.userIdByHandle[handle]; taken && owner != userId {
+		return "", ErrHandleTaken
+	}
+	return handle, nil
+}
+
+func (dbStructure *DBStructure) authenticateUser(email string, password string) (User, error) {
+	user, ok := dbStructure.userByEmail(email)
+	if !ok {
+		return User{}, ErrUnknownEmail
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return User{}, ErrIncorrectPassword
+	}
+	return user.User, nil
+}
+
+func (dbStructure *DBStructure) getUser(userId string) (User, error) {
+	user, ok := dbStructure.Users[userId]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user.User, nil
+}
+
+func (b *batch) updateUser(userId string, newEmail, newPassword, newHandle string) (User, error) {
+	user, ok := b.Users[userId]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if owner, taken := b.userByEmail(newEmail); taken && owner.Id != userId {
+		return User{}, ErrEmailTaken
+	}
+	if newHandle != "" {
+		handle, handleErr := b.claimHandle(userId, newHandle)
+		if handleErr != nil {
+			return User{}, handleErr
+		}
+		user.Handle = handle
+	}
+	user.Email = newEmail
+	user.Password = newPassword
+	user.UpdatedAt = b.now
+	b.putUser(opUserUpdated, user)
+	return user.User, nil
+}
+
+func (b *batch) upgradeUser(userId string) error {
+	user, ok := b.Users[userId]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user.IsChirpyRed = true
+	user.UpdatedAt = b.now
+	b.putUser(opUserUpgraded, user)
+	return nil
+}
+
+func (b *batch) deleteUser(userId string) error {
+	user, ok := b.Users[userId]
+	if !ok {
+		return ErrUserNotFound
+	}
+	b.unlikeAllBy(userId)
+	b.putUser(opUserDeleted, user)
+	return nil
+}
@@ -0,0 +1,105 @@
+package fsdb
+
+// ThreadNode is a chirp in a conversation along with the replies to it.
+// Chirps that were deleted stay in the tree as nodes without a Chirp as long
+// as replies to them are left, so the conversation keeps its shape.
+type ThreadNode struct {
+	Id    string `json:"id"`
+	Chirp *Chirp `json:"chirp"`
+	// ReplyCount is the number of chirps replying to this one directly.
+	ReplyCount int           `json:"reply_count"`
+	Replies    []*ThreadNode `json:"replies"`
+}
+
+// GetThread returns the whole conversation the live chirp with chirpId is
+// part of, starting with the chirp that began it. Replies are in the order
+// they were posted in.
+func (tx *Tx) GetThread(chirpId string) (*ThreadNode, error) {
+	return tx.b.getThread(chirpId)
+}
+
+func (s txStore) GetThread(chirpId string) (*ThreadNode, error) {
+	var thread *ThreadNode
+	err := s.runner.View(func(tx *Tx) error {
+		var getErr error
+		thread, getErr = tx.GetThread(chirpId)
+		return getErr
+	})
+	return thread, err
+}
+
+// threadRootId returns the id of the chirp that started the conversation.
+func (chirp Chirp) threadRootId() string {
+	if chirp.RootId != "" {
+		return chirp.RootId
+	}
+	return chirp.Id
+}
+
+// conversationStart follows the replies above chirp up to the chirp that
+// started the conversation. It reports false if a parent is missing or the
+// replies go round in a cycle.
+func (dbStructure *DBStructure) conversationStart(chirp Chirp) (string, bool) {
+	seen := map[string]bool{chirp.Id: true}
+	for chirp.InReplyTo != "" {
+		parent, exists := dbStructure.Chirps[chirp.InReplyTo]
+		if !exists || seen[parent.Id] {
+			return "", false
+		}
+		seen[parent.Id] = true
+		chirp = parent
+	}
+	return chirp.Id, true
+}
+
+func (dbStructure *DBStructure) getThread(chirpId string) (*ThreadNode, error) {
+	chirp, getErr := dbStructure.getUniqueChirp(chirpId)
+	if getErr != nil {
+		return nil, getErr
+	}
+	rootId := chirp.threadRootId()
+
+	nodes := map[string]*ThreadNode{}
+	node := func(id string) *ThreadNode {
+		if n, ok := nodes[id]; ok {
+			return n
+		}
+		n := &ThreadNode{Id: id, Replies: []*ThreadNode{}}
+		if chirp, ok := dbStructure.Chirps[id]; ok && chirp.DeletedAt == nil {
+			n.Chirp = &chirp
+		}
+		nodes[id] = n
+		return n
+	}
+	root := node(rootId)
+	// The replies are listed in the order they were created in, so every
+	// reply is added to its parent after the chirps posted before it. A parent that was purged
+	// can't say what it replied to, so its node hangs off the root.
+	for _, id := range dbStructure.indexes.chirpsByRoot[rootId] {
+		reply := node(id)
+		parentId := dbStructure.Chirps[id].InReplyTo
+		parent := node(parentId)
+		if _, exists := dbStructure.Chirps[parentId]; !exists && parent != root && len(parent.Replies) == 0 {
+			root.Replies = append(root.Replies, parent)
+		}
+		parent.Replies = append(parent.Replies, reply)
+	}
+	prune(root)
+	return root, nil
+}
+
+// prune drops the nodes of deleted chirps nobody replied to and counts the
+// replies left. It reports whether n itself is worth keeping.
+func prune(n *ThreadNode) bool {
+	kept := n.Replies[:0]
+	for _, reply := range n.Replies {
+		if prune(reply) {
+			kept = append(kept, reply)
+		}
+		if reply.Chirp != nil {
+			n.ReplyCount++
+		}
+	}
+	n.Replies = kept
+	return n.Chirp != nil || len(n.Replies) > 0
+}
@@ -0,0 +1,39 @@
+package fsdb
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestThreadRepliesAreInPostingOrder(t *testing.T) {
+	// The ids of the imported replies don't follow the order they were
+	// posted in.
+	export := strings.Join([]string{
+		`{"type":"user","user":{"id":"1","email":"a@x.com","password":"x"}}`,
+		`{"type":"chirp","chirp":{"id":"1","author_id":"1","body":"root","created_at":"2024-01-01T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"2","author_id":"1","body":"third","in_reply_to":"1","root_id":"1","created_at":"2024-01-04T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"3","author_id":"1","body":"first","in_reply_to":"1","root_id":"1","created_at":"2024-01-02T00:00:00Z"}}`,
+		`{"type":"chirp","chirp":{"id":"4","author_id":"1","body":"second","in_reply_to":"1","root_id":"1","created_at":"2024-01-03T00:00:00Z"}}`,
+	}, "\n")
+	db := NewMemDB()
+	if _, importErr := Import(db, strings.NewReader(export), ImportOptions{KeepIds: true}); importErr != nil {
+		t.Fatal(importErr)
+	}
+	// A reply posted now comes last.
+	if _, chirpErr := db.CreateReply("fourth", "1", "1"); chirpErr != nil {
+		t.Fatal(chirpErr)
+	}
+
+	thread, threadErr := db.GetThread("1")
+	if threadErr != nil {
+		t.Fatal(threadErr)
+	}
+	got := []string{}
+	for _, reply := range thread.Replies {
+		got = append(got, reply.Chirp.Body)
+	}
+	if want := []string{"first", "second", "third", "fourth"}; !slices.Equal(got, want) {
+		t.Errorf("got replies %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,40 @@
+package fsdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// revokedTokenKey identifies a token in RevokedTokens without storing the
+// bearer token itself.
+func revokedTokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *batch) revokeToken(token string, expiresAt time.Time) {
+	b.putRevokedToken(revokedTokenKey(token), expiresAt)
+}
+
+func (dbStructure *DBStructure) isTokenRevoked(token string) error {
+	_, ok := dbStructure.RevokedTokens[revokedTokenKey(token)]
+	if ok {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// pruneRevokedTokens drops entries for tokens that have expired by now. An
+// expired token is rejected on its own, so remembering its revocation serves
+// no purpose.
+func (b *batch) pruneRevokedTokens(now time.Time) int {
+	pruned := 0
+	for tokenKey, expiresAt := range b.RevokedTokens {
+		if !expiresAt.After(now) {
+			b.removeRevokedToken(tokenKey)
+			pruned++
+		}
+	}
+	return pruned
+}
@@ -0,0 +1,341 @@
+package fsdb
+
+import "time"
+
+// Tx gives access to the database inside View and Update. Reads see a
+// consistent state including the transaction's own writes. A Tx must not be
+// used after the function it was passed to has returned.
+type Tx struct {
+	b        *batch
+	writable bool
+	sealer   *sealer
+}
+
+func (tx *Tx) checkWritable() error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	return nil
+}
+
+func (tx *Tx) GetChirps() ([]Chirp, error) {
+	return tx.b.getChirps(), nil
+}
+
+func (tx *Tx) GetChirpsFromAuthor(authorId string) ([]Chirp, error) {
+	return tx.b.getChirpsFromAuthor(authorId), nil
+}
+
+func (tx *Tx) GetUniqueChirp(chirpId string) (Chirp, error) {
+	return tx.b.getUniqueChirp(chirpId)
+}
+
+func (tx *Tx) CreateChirp(body string, createdById string) (Chirp, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return Chirp{}, writableErr
+	}
+	return tx.b.createChirp(body, createdById, "")
+}
+
+// CreateReply adds a chirp replying to the live chirp with parentId.
+func (tx *Tx) CreateReply(body string, createdById string, parentId string) (Chirp, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return Chirp{}, writableErr
+	}
+	return tx.b.createChirp(body, createdById, parentId)
+}
+
+// DeleteChirp soft-deletes a chirp. It stays restorable with UndeleteChirp
+// until PurgeDeletedChirps removes it.
+func (tx *Tx) DeleteChirp(chirpId, userId string) error {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return writableErr
+	}
+	return tx.b.deleteChirp(chirpId, userId)
+}
+
+// UndeleteChirp restores a chirp its author deleted at most grace ago.
+func (tx *Tx) UndeleteChirp(chirpId, userId string, grace time.Duration) (Chirp, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return Chirp{}, writableErr
+	}
+	return tx.b.undeleteChirp(chirpId, userId, grace)
+}
+
+// GetDeletedChirps lists the chirps that are deleted but not purged yet.
+func (tx *Tx) GetDeletedChirps() ([]Chirp, error) {
+	return tx.b.getDeletedChirps(), nil
+}
+
+// PurgeDeletedChirps permanently removes chirps deleted before cutoff and
+// returns how many were removed.
+func (tx *Tx) PurgeDeletedChirps(cutoff time.Time) (int, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return 0, writableErr
+	}
+	return tx.b.purgeDeletedChirps(cutoff), nil
+}
+
+func (tx *Tx) CreateUser(email, password, handle string) (User, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return User{}, writableErr
+	}
+	return tx.b.createUser(email, password, handle)
+}
+
+func (tx *Tx) AuthenticateUser(email string, password string) (User, error) {
+	return tx.b.authenticateUser(email, password)
+}
+
+func (tx *Tx) GetUser(userId string) (User, error) {
+	return tx.b.getUser(userId)
+}
+
+// UpdateUser replaces the email and password of a user, and their handle
+// unless newHandle is empty.
+func (tx *Tx) UpdateUser(userId string, newEmail, newPassword, newHandle string) (User, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return User{}, writableErr
+	}
+	return tx.b.updateUser(userId, newEmail, newPassword, newHandle)
+}
+
+func (tx *Tx) UpgradeUser(userId string) error {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return writableErr
+	}
+	return tx.b.upgradeUser(userId)
+}
+
+// DeleteUser removes a user account. Chirps written by the user are left in
+// place; delete them in the same transaction if they should go too.
+func (tx *Tx) DeleteUser(userId string) error {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return writableErr
+	}
+	return tx.b.deleteUser(userId)
+}
+
+// RevokeToken marks token as revoked until expiresAt, the expiry of the
+// token itself.
+func (tx *Tx) RevokeToken(token string, expiresAt time.Time) error {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return writableErr
+	}
+	tx.b.revokeToken(token, expiresAt)
+	return nil
+}
+
+func (tx *Tx) IsTokenRevoked(token string) error {
+	return tx.b.isTokenRevoked(token)
+}
+
+// PruneRevokedTokens forgets revoked tokens that have expired by now and
+// returns how many were removed.
+func (tx *Tx) PruneRevokedTokens(now time.Time) (int, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return 0, writableErr
+	}
+	return tx.b.pruneRevokedTokens(now), nil
+}
+
+func (tx *Tx) CountRevokedTokens() (int, error) {
+	return len(tx.b.RevokedTokens), nil
+}
+
+// txRunner is implemented by every Store.
+type txRunner interface {
+	View(fn func(tx *Tx) error) error
+	Update(fn func(tx *Tx) error) error
+}
+
+// txStore implements the single-operation Store methods on top of View and
+// Update, so DB and MemDB only need to provide those two.
+type txStore struct {
+	runner txRunner
+}
+
+func (s txStore) GetChirps() ([]Chirp, error) {
+	var chirps []Chirp
+	err := s.runner.View(func(tx *Tx) error {
+		var getErr error
+		chirps, getErr = tx.GetChirps()
+		return getErr
+	})
+	return chirps, err
+}
+
+func (s txStore) GetChirpsFromAuthor(authorId string) ([]Chirp, error) {
+	var chirps []Chirp
+	err := s.runner.View(func(tx *Tx) error {
+		var getErr error
+		chirps, getErr = tx.GetChirpsFromAuthor(authorId)
+		return getErr
+	})
+	return chirps, err
+}
+
+func (s txStore) GetUniqueChirp(chirpId string) (Chirp, error) {
+	var chirp Chirp
+	err := s.runner.View(func(tx *Tx) error {
+		var getErr error
+		chirp, getErr = tx.GetUniqueChirp(chirpId)
+		return getErr
+	})
+	return chirp, err
+}
+
+func (s txStore) CreateChirp(body string, createdById string) (Chirp, error) {
+	var chirp Chirp
+	err := s.runner.Update(func(tx *Tx) error {
+		var createErr error
+		chirp, createErr = tx.CreateChirp(body, createdById)
+		return createErr
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (s txStore) CreateReply(body string, createdById string, parentId string) (Chirp, error) {
+	var chirp Chirp
+	err := s.runner.Update(func(tx *Tx) error {
+		var createErr error
+		chirp, createErr = tx.CreateReply(body, createdById, parentId)
+		return createErr
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (s txStore) DeleteChirp(chirpId, userId string) error {
+	return s.runner.Update(func(tx *Tx) error {
+		return tx.DeleteChirp(chirpId, userId)
+	})
+}
+
+func (s txStore) UndeleteChirp(chirpId, userId string, grace time.Duration) (Chirp, error) {
+	var chirp Chirp
+	err := s.runner.Update(func(tx *Tx) error {
+		var undeleteErr error
+		chirp, undeleteErr = tx.UndeleteChirp(chirpId, userId, grace)
+		return undeleteErr
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (s txStore) GetDeletedChirps() ([]Chirp, error) {
+	var chirps []Chirp
+	err := s.runner.View(func(tx *Tx) error {
+		var getErr error
+		chirps, getErr = tx.GetDeletedChirps()
+		return getErr
+	})
+	return chirps, err
+}
+
+func (s txStore) PurgeDeletedChirps(cutoff time.Time) (int, error) {
+	var purged int
+	err := s.runner.Update(func(tx *Tx) error {
+		var purgeErr error
+		purged, purgeErr = tx.PurgeDeletedChirps(cutoff)
+		return purgeErr
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+func (s txStore) CreateUser(email, password, handle string) (User, error) {
+	var user User
+	err := s.runner.Update(func(tx *Tx) error {
+		var createErr error
+		user, createErr = tx.CreateUser(email, password, handle)
+		return createErr
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s txStore) AuthenticateUser(email string, password string) (User, error) {
+	var user User
+	err := s.runner.View(func(tx *Tx) error {
+		var authErr error
+		user, authErr = tx.AuthenticateUser(email, password)
+		return authErr
+	})
+	return user, err
+}
+
+func (s txStore) GetUser(userId string) (User, error) {
+	var user User
+	err := s.runner.View(func(tx *Tx) error {
+		var getErr error
+		user, getErr = tx.GetUser(userId)
+		return getErr
+	})
+	return user, err
+}
+
+func (s txStore) UpdateUser(userId string, newEmail, newPassword, newHandle string) (User, error) {
+	var user User
+	err := s.runner.Update(func(tx *Tx) error {
+		var updateErr error
+		user, updateErr = tx.UpdateUser(userId, newEmail, newPassword, newHandle)
+		return updateErr
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s txStore) UpgradeUser(userId string) error {
+	return s.runner.Update(func(tx *Tx) error {
+		return tx.UpgradeUser(userId)
+	})
+}
+
+func (s txStore) RevokeToken(token string, expiresAt time.Time) error {
+	return s.runner.Update(func(tx *Tx) error {
+		return tx.RevokeToken(token, expiresAt)
+	})
+}
+
+func (s txStore) IsTokenRevoked(token string) error {
+	return s.runner.View(func(tx *Tx) error {
+		return tx.IsTokenRevoked(token)
+	})
+}
+
+func (s txStore) PruneRevokedTokens(now time.Time) (int, error) {
+	var pruned int
+	err := s.runner.Update(func(tx *Tx) error {
+		var pruneErr error
+		pruned, pruneErr = tx.PruneRevokedTokens(now)
+		return pruneErr
+	})
+	if err != nil {
+		return 0, err
+	}
+	return pruned, nil
+}
+
+func (s txStore) CountRevokedTokens() (int, error) {
+	var count int
+	err := s.runner.View(func(tx *Tx) error {
+		var countErr error
+		count, countErr = tx.CountRevokedTokens()
+		return countErr
+	})
+	return count, err
+}
@@ -0,0 +1,103 @@
+package fsdb
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(t *testing.T, password string) string {
+	t.Helper()
+	hash, hashErr := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if hashErr != nil {
+		t.Fatal(hashErr)
+	}
+	return string(hash)
+}
+
+func TestUpdateUserRejectsTakenEmail(t *testing.T) {
+	db := NewMemDB()
+	alice, createErr := db.CreateUser("a@x.com", hashPassword(t, "alice"), "")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	bob, createErr := db.CreateUser("b@x.com", hashPassword(t, "bob"), "")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	if _, updateErr := db.UpdateUser(bob.Id, "a@x.com", hashPassword(t, "bob"), ""); !errors.Is(updateErr, ErrEmailTaken) {
+		t.Fatalf("taking another user's email: got %v, want ErrEmailTaken", updateErr)
+	}
+	if user, authErr := db.AuthenticateUser("a@x.com", "alice"); authErr != nil || user.Id != alice.Id {
+		t.Fatalf("logging in as the owner of the email: got user %q, %v", user.Id, authErr)
+	}
+	if _, authErr := db.AuthenticateUser("a@x.com", "bob"); !errors.Is(authErr, ErrIncorrectPassword) {
+		t.Fatalf("logging in with the other user's password: got %v, want ErrIncorrectPassword", authErr)
+	}
+
+	if _, updateErr := db.UpdateUser(bob.Id, "b@x.com", hashPassword(t, "bob2"), ""); updateErr != nil {
+		t.Fatalf("keeping one's own email: %v", updateErr)
+	}
+}
+
+func TestUpdateUserMovesEmail(t *testing.T) {
+	db := NewMemDB()
+	bob, createErr := db.CreateUser("b@x.com", hashPassword(t, "bob"), "")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	if _, updateErr := db.UpdateUser(bob.Id, "bob@x.com", hashPassword(t, "bob"), ""); updateErr != nil {
+		t.Fatal(updateErr)
+	}
+
+	if _, authErr := db.AuthenticateUser("b@x.com", "bob"); !errors.Is(authErr, ErrUnknownEmail) {
+		t.Fatalf("logging in with the old email: got %v, want ErrUnknownEmail", authErr)
+	}
+	if user, authErr := db.AuthenticateUser("bob@x.com", "bob"); authErr != nil || user.Id != bob.Id {
+		t.Fatalf("logging in with the new email: got user %q, %v", user.Id, authErr)
+	}
+	// The old email is free for others now.
+	if _, createErr := db.CreateUser("b@x.com", hashPassword(t, "carol"), ""); createErr != nil {
+		t.Fatalf("reusing the old email: %v", createErr)
+	}
+}
+
+func TestMentionsResolveByHandle(t *testing.T) {
+	db := NewMemDB()
+	alice, createErr := db.CreateUser("a@x.com", hashPassword(t, "alice"), "@Alice")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	if alice.Handle != "alice" {
+		t.Fatalf("handle: got %q, want %q", alice.Handle, "alice")
+	}
+	// An email that starts with a handle doesn't claim it.
+	bob, createErr := db.CreateUser("alice@y.com", hashPassword(t, "bob"), "")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	if _, createErr := db.CreateUser("c@x.com", hashPassword(t, "carol"), "ALICE"); !errors.Is(createErr, ErrHandleTaken) {
+		t.Fatalf("taking another user's handle: got %v, want ErrHandleTaken", createErr)
+	}
+	if _, updateErr := db.UpdateUser(bob.Id, "alice@y.com", hashPassword(t, "bob"), "bob."); !errors.Is(updateErr, ErrInvalidHandle) {
+		t.Fatalf("a handle ending in a dot: got %v, want ErrInvalidHandle", updateErr)
+	}
+
+	chirp, chirpErr := db.CreateChirp("hi @alice and @a", bob.Id)
+	if chirpErr != nil {
+		t.Fatal(chirpErr)
+	}
+	if len(chirp.Mentions) != 1 || chirp.Mentions[0].UserId != alice.Id {
+		t.Fatalf("mentions: got %+v, want only user %s", chirp.Mentions, alice.Id)
+	}
+
+	// A handle that was given up is free for others.
+	if _, updateErr := db.UpdateUser(alice.Id, "a@x.com", hashPassword(t, "alice"), "al"); updateErr != nil {
+		t.Fatal(updateErr)
+	}
+	if _, updateErr := db.UpdateUser(bob.Id, "alice@y.com", hashPassword(t, "bob"), "alice"); updateErr != nil {
+		t.Fatalf("reusing a given up handle: %v", updateErr)
+	}
+}
@@ -0,0 +1,167 @@
+package fsdb
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Kinds of IntegrityProblem.
+const (
+	ProblemDuplicateEmail  = "duplicate-email"
+	ProblemDuplicateHandle = "duplicate-handle"
+	ProblemOrphanedChirp   = "orphaned-chirp"
+	ProblemIdCounter       = "id-counter"
+	ProblemDanglingLike    = "dangling-like"
+)
+
+// IntegrityProblem is an inconsistency between the collections of a
+// database, usually the result of editing the file by hand. Chirps left
+// behind by DeleteUser count as orphaned too.
+type IntegrityProblem struct {
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+func (problem IntegrityProblem) String() string {
+	return problem.Kind + ": " + problem.Detail
+}
+
+// CheckIntegrity lists the integrity problems of the database.
+func (tx *Tx) CheckIntegrity() ([]IntegrityProblem, error) {
+	return tx.b.checkIntegrity(false)
+}
+
+// RepairIntegrity fixes every integrity problem and returns what it fixed.
+// Of several users sharing an email, the oldest keeps it and the others are
+// deleted; of several sharing a handle, the oldest keeps it and the others
+// are left without one. Live chirps without an author, including those of
+// the deleted duplicates, are soft-deleted. Likes by users or of chirps that
+// don't exist or were deleted are taken back. Id counters are moved past the
+// highest id in use.
+func (tx *Tx) RepairIntegrity() ([]IntegrityProblem, error) {
+	if writableErr := tx.checkWritable(); writableErr != nil {
+		return nil, writableErr
+	}
+	return tx.b.checkIntegrity(true)
+}
+
+// checkIntegrity finds integrity problems and, with repair set, fixes each
+// one as it is found, so problems caused by an earlier fix are found too.
+func (b *batch) checkIntegrity(repair bool) ([]IntegrityProblem, error) {
+	problems := []IntegrityProblem{}
+
+	usersByEmail := map[string][]string{}
+	for id, user := range b.Users {
+		usersByEmail[user.Email] = append(usersByEmail[user.Email], id)
+	}
+	emails := make([]string, 0, len(usersByEmail))
+	for email, ids := range usersByEmail {
+		if len(ids) > 1 {
+			emails = append(emails, email)
+		}
+	}
+	sort.Strings(emails)
+	for _, email := range emails {
+		ids := usersByEmail[email]
+		slices.SortFunc(ids, compareIds)
+		problems = append(problems, IntegrityProblem{
+			Kind:   ProblemDuplicateEmail,
+			Detail: fmt.Sprintf("users %v share the email %s", ids, email),
+		})
+		if repair {
+			for _, id := range ids[1:] {
+				b.unlikeAllBy(id)
+				b.putUser(opUserDeleted, b.Users[id])
+			}
+		}
+	}
+
+	usersByHandle := map[string][]string{}
+	for id, user := range b.Users {
+		if user.Handle != "" {
+			usersByHandle[user.Handle] = append(usersByHandle[user.Handle], id)
+		}
+	}
+	handles := make([]string, 0, len(usersByHandle))
+	for handle, ids := range usersByHandle {
+		if len(ids) > 1 {
+			handles = append(handles, handle)
+		}
+	}
+	sort.Strings(handles)
+	for _, handle := range handles {
+		ids := usersByHandle[handle]
+		slices.SortFunc(ids, compareIds)
+		problems = append(problems, IntegrityProblem{
+			Kind:   ProblemDuplicateHandle,
+			Detail: fmt.Sprintf("users %v share the handle %s", ids, handle),
+		})
+		if repair {
+			for _, id := range ids[1:] {
+				user := b.Users[id]
+				user.Handle = ""
+				user.UpdatedAt = b.now
+				b.putUser(opUserUpdated, user)
+			}
+		}
+	}
+
+	for _, chirp := range b.getChirps() {
+		if _, ok := b.Users[chirp.AuthorId]; ok {
+			continue
+		}
+		problems = append(problems, IntegrityProblem{
+			Kind:   ProblemOrphanedChirp,
+			Detail: fmt.Sprintf("chirp %s was written by user %s, who doesn't exist", chirp.Id, chirp.AuthorId),
+		})
+		if repair {
+			deletedAt := b.now
+			chirp.DeletedAt = &deletedAt
+			chirp.UpdatedAt = b.now
+			b.unlikeAll(chirp.Id)
+			b.putChirp(opChirpSoftDeleted, chirp)
+		}
+	}
+
+	chirpIds := make([]string, 0, len(b.Likes))
+	for chirpId := range b.Likes {
+		chirpIds = append(chirpIds, chirpId)
+	}
+	slices.SortFunc(chirpIds, compareIds)
+	for _, chirpId := range chirpIds {
+		chirp, chirpExists := b.Chirps[chirpId]
+		for _, like := range b.likesOf(chirpId) {
+			_, userExists := b.Users[like.UserId]
+			if chirpExists && chirp.DeletedAt == nil && userExists {
+				continue
+			}
+			problems = append(problems, IntegrityProblem{
+				Kind:   ProblemDanglingLike,
+				Detail: fmt.Sprintf("user %s likes chirp %s, but one of them doesn't exist or was deleted", like.UserId, chirpId),
+			})
+			if repair {
+				b.putLike(opChirpUnliked, like)
+			}
+		}
+	}
+
+	for _, counter := range []struct {
+		key   string
+		maxId int
+	}{{"nextChirpId", maxNumericId(b.Chirps)}, {"nextUserId", maxNumericId(b.Users)}} {
+		nextId, atoiErr := strconv.Atoi(b.Metadata[counter.key])
+		if atoiErr == nil && nextId > counter.maxId {
+			continue
+		}
+		problems = append(problems, IntegrityProblem{
+			Kind:   ProblemIdCounter,
+			Detail: fmt.Sprintf("%s is %q, but id %d is already taken", counter.key, b.Metadata[counter.key], counter.maxId),
+		})
+		if repair {
+			b.setMetadata(counter.key, strconv.Itoa(counter.maxId+1))
+		}
+	}
+	return problems, nil
+}
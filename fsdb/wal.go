@@ -0,0 +1,204 @@
+package fsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	walSuffix = ".wal"
+	// walSeqKey is the metadata key holding the sequence number of the last
+	// journal entry contained in the snapshot.
+	walSeqKey = "walSeq"
+
+	defaultCompactAfter = 1000
+)
+
+// walEntry is one line of the journal. All records of an entry belong to the
+// same write operation and are replayed together or not at all.
+type walEntry struct {
+	Seq     uint64   `json:"seq"`
+	Records []record `json:"records"`
+}
+
+// journal is an append-only log of mutations kept next to the snapshot file.
+// With encryption enabled, each line holds an encrypted entry.
+type journal struct {
+	path    string
+	file    *os.File
+	size    int64
+	seq     uint64
+	entries int
+	sealer  *sealer
+}
+
+func openJournal(path string, seq uint64, s *sealer) (*journal, error) {
+	file, openErr := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if openErr != nil {
+		return nil, openErr
+	}
+	info, statErr := file.Stat()
+	if statErr != nil {
+		file.Close()
+		return nil, statErr
+	}
+	return &journal{path: path, file: file, size: info.Size(), seq: seq, sealer: s}, nil
+}
+
+// append durably writes records as a single entry. If the write fails the
+// file is truncated back to its previous length so a torn entry never ends
+// up in front of later ones.
+func (j *journal) append(records []record) error {
+	entry := walEntry{Seq: j.seq + 1, Records: records}
+	plain, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	dat, sealErr := j.sealer.seal(plain, journalContext)
+	if sealErr != nil {
+		return sealErr
+	}
+	dat = append(dat, '\n')
+	_, writeErr := j.file.Write(dat)
+	if writeErr == nil {
+		writeErr = j.file.Sync()
+	}
+	if writeErr != nil {
+		j.file.Truncate(j.size)
+		return writeErr
+	}
+	j.size += int64(len(dat))
+	j.seq = entry.Seq
+	j.entries++
+	return nil
+}
+
+// reset empties the journal once its entries are part of the snapshot.
+func (j *journal) reset() error {
+	if truncateErr := j.file.Truncate(0); truncateErr != nil {
+		return truncateErr
+	}
+	j.size = 0
+	j.entries = 0
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// replayJournal applies every entry of the journal at path that is newer than
+// the snapshot in dbStructure. A trailing entry cut short by a crash is
+// discarded, and removed from the file unless readOnly is set; damage
+// anywhere else is an error. It returns the sequence number of the last entry
+// seen and how many entries were applied.
+func replayJournal(path string, dbStructure *DBStructure, s *sealer, readOnly bool) (uint64, int, error) {
+	snapshotSeq, _ := strconv.ParseUint(dbStructure.Metadata[walSeqKey], 10, 64)
+	dat, readErr := os.ReadFile(path)
+	if errors.Is(readErr, os.ErrNotExist) {
+		return snapshotSeq, 0, nil
+	}
+	if readErr != nil {
+		return 0, 0, readErr
+	}
+
+	lastSeq := snapshotSeq
+	applied := 0
+	offset := 0
+	for offset < len(dat) {
+		lineEnd := bytes.IndexByte(dat[offset:], '\n')
+		entry := walEntry{}
+		var decodeErr error
+		if lineEnd >= 0 {
+			decodeErr = decodeWalEntry(dat[offset:offset+lineEnd], s, &entry)
+		}
+		if errors.Is(decodeErr, ErrEncrypted) || errors.Is(decodeErr, ErrWrongKey) {
+			return 0, 0, fmt.Errorf("journal %s: %w", path, decodeErr)
+		}
+		if lineEnd < 0 || decodeErr != nil {
+			if lineEnd < 0 || offset+lineEnd+1 == len(dat) {
+				if readOnly {
+					return lastSeq, applied, nil
+				}
+				return lastSeq, applied, os.Truncate(path, int64(offset))
+			}
+			return 0, 0, fmt.Errorf("journal %s is corrupt at byte %d", path, offset)
+		}
+		offset += lineEnd + 1
+		if entry.Seq > lastSeq {
+			lastSeq = entry.Seq
+		}
+		if entry.Seq <= snapshotSeq {
+			continue
+		}
+		for _, rec := range entry.Records {
+			dbStructure.apply(rec)
+		}
+		applied++
+	}
+	return lastSeq, applied, nil
+}
+
+// decodeWalEntry decodes one line of the journal. Its records are upgraded
+// first, as the journal may have been written by an older version.
+func decodeWalEntry(line []byte, s *sealer, entry *walEntry) error {
+	plain, openErr := s.open(line, journalContext)
+	if openErr != nil {
+		return openErr
+	}
+	raw := struct {
+		Seq     uint64            `json:"seq"`
+		Records []json.RawMessage `json:"records"`
+	}{}
+	if unmarshalErr := json.Unmarshal(plain, &raw); unmarshalErr != nil {
+		return unmarshalErr
+	}
+	entry.Seq = raw.Seq
+	entry.Records = make([]record, len(raw.Records))
+	for i, rawRecord := range raw.Records {
+		upgraded, upgradeErr := upgradeRecord(rawRecord)
+		if upgradeErr != nil {
+			return upgradeErr
+		}
+		if unmarshalErr := json.Unmarshal(upgraded, &entry.Records[i]); unmarshalErr != nil {
+			return unmarshalErr
+		}
+	}
+	return nil
+}
+
+// compact writes the current state as a new snapshot and empties the
+// journal. A sharded database only rewrites the files changed since the last
+// snapshot; set db.unsaved to nil first to rewrite all of them. The caller
+// must hold the write lock.
+func (db *DB) compact() error {
+	if db.journal == nil {
+		return nil
+	}
+	db.dbStructure.Metadata[walSeqKey] = strconv.FormatUint(db.journal.seq, 10)
+	shards := db.unsaved.add(shardSet{metadataShard: true})
+	if writeErr := db.writeDB(db.dbStructure, shards); writeErr != nil {
+		return writeErr
+	}
+	db.unsaved = shardSet{}
+	return db.journal.reset()
+}
+
+// Compact rewrites the snapshot file from the current state, folding the
+// journal into it if journaling is enabled.
+func (db *DB) Compact() error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.journal == nil {
+		return db.writeDB(db.dbStructure, nil)
+	}
+	db.unsaved = nil
+	return db.compact()
+}
@@ -0,0 +1,78 @@
+package fsdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// journalOfThreeWrites returns the journal left by three writes to a
+// database opened with journaling.
+func journalOfThreeWrites(t *testing.T) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, openErr := Open(path, Options{Journal: true})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	user, createErr := db.CreateUser("a@x.com", "x", "")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	for _, body := range []string{"first", "second"} {
+		if _, chirpErr := db.CreateChirp(body, user.Id); chirpErr != nil {
+			t.Fatal(chirpErr)
+		}
+	}
+	dat, readErr := os.ReadFile(path + walSuffix)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return dat
+}
+
+func TestJournalReplayDropsTornLastEntry(t *testing.T) {
+	dat := journalOfThreeWrites(t)
+	path := filepath.Join(t.TempDir(), "database.json"+walSuffix)
+	torn := append(bytes.Clone(dat), `{"seq":4,"records":[{"op":"chirp.cre`...)
+	if writeErr := os.WriteFile(path, torn, 0o666); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	dbStructure := newDBStructure()
+	lastSeq, applied, replayErr := replayJournal(path, &dbStructure, nil, false)
+	if replayErr != nil {
+		t.Fatal(replayErr)
+	}
+	if lastSeq != 3 || applied != 3 {
+		t.Errorf("got last seq %d and %d entries applied, want 3 and 3", lastSeq, applied)
+	}
+	if len(dbStructure.Users) != 1 || len(dbStructure.Chirps) != 2 {
+		t.Errorf("got %d users and %d chirps, want 1 and 2", len(dbStructure.Users), len(dbStructure.Chirps))
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, dat) {
+		t.Errorf("journal is %d bytes after replay, want the %d bytes before the torn entry", len(after), len(dat))
+	}
+}
+
+func TestJournalReplayRejectsDamageBeforeTheEnd(t *testing.T) {
+	dat := journalOfThreeWrites(t)
+	path := filepath.Join(t.TempDir(), "database.json"+walSuffix)
+	firstLineEnd := bytes.IndexByte(dat, '\n') + 1
+	damaged := append(append(bytes.Clone(dat[:firstLineEnd]), "garbage\n"...), dat[firstLineEnd:]...)
+	if writeErr := os.WriteFile(path, damaged, 0o666); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	dbStructure := newDBStructure()
+	_, _, replayErr := replayJournal(path, &dbStructure, nil, false)
+	if replayErr == nil || !strings.Contains(replayErr.Error(), "corrupt") {
+		t.Fatalf("got %v, want a corrupt journal error", replayErr)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, damaged) {
+		t.Error("damaged journal was modified")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fsdb"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// likesPostHandler likes a chirp on behalf of the user of the access token
+// and responds with the chirp and its new count. Liking it again is fine.
+func (cfg *apiConfig) likesPostHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := cfg.authenticateAccess(w, r)
+	if !ok {
+		return
+	}
+	chirp, likeErr := cfg.db.LikeChirp(chi.URLParam(r, "chirpId"), userId)
+	if likeErr != nil {
+		respondWithStoreError(w, likeErr)
+		return
+	}
+	respondWithJSON(w, 200, chirp)
+}
+
+// likesDeleteHandler takes back the like of the user of the access token,
+// if there is one, and responds with the chirp.
+func (cfg *apiConfig) likesDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := cfg.authenticateAccess(w, r)
+	if !ok {
+		return
+	}
+	chirp, unlikeErr := cfg.db.UnlikeChirp(chi.URLParam(r, "chirpId"), userId)
+	if unlikeErr != nil {
+		respondWithStoreError(w, unlikeErr)
+		return
+	}
+	respondWithJSON(w, 200, chirp)
+}
+
+// likesGetHandler lists who liked a chirp, earliest like first.
+func (cfg *apiConfig) likesGetHandler(w http.ResponseWriter, r *http.Request) {
+	likes, getErr := cfg.db.GetChirpLikes(chi.URLParam(r, "chirpId"))
+	if getErr != nil {
+		respondWithStoreError(w, getErr)
+		return
+	}
+	respondWithJSON(w, 200, likes)
+}
+
+// likedChirpsGetHandler lists the chirps the user of the access token likes
+// like chirpsGetHandler.
+func (cfg *apiConfig) likedChirpsGetHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := cfg.authenticateAccess(w, r)
+	if !ok {
+		return
+	}
+	cfg.respondWithChirpPage(w, r, fsdb.ChirpQuery{
+		AuthorId:      r.URL.Query().Get("author_id"),
+		LikedByUserId: userId,
+	})
+}
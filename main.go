@@ -2,66 +2,124 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"fsdb"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/joho/godotenv"
 )
 
 type apiConfig struct {
-	fileServerHits int
-	jwtSecret      string
-	polkaApiKey    string
-	db             *fsdb.DB
+	fileServerHits  int
+	jwtSecret       string
+	polkaApiKey     string
+	adminApiKey     string
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	db              fsdb.Store
+	backupDir       string
+	backupsKept     int
 }
 
-func startServer(port string, debug bool, dbPathChan chan string) {
-	// Connect to database, load environment variables from .env-file
-	// and set up api config
-	var db *fsdb.DB
-	var dbErr error
-	if debug {
-		db, dbErr = fsdb.NewDB("./database.debug.json")
-	} else {
-		db, dbErr = fsdb.NewDB("./database.json")
-	}
-	if dbErr != nil {
-		log.Fatal("Could not open database connection", dbErr.Error())
+const (
+	// Authors can restore their deleted chirps for undeleteGracePeriod;
+	// moderators can see them until they are purged after
+	// deletedChirpRetention.
+	undeleteGracePeriod   = 24 * time.Hour
+	deletedChirpRetention = 30 * 24 * time.Hour
+	// staticDir holds the files served under /app.
+	staticDir = "public"
+)
+
+// openStore connects to the storage backend selected in the config. The
+// returned path is empty for backends that don't live on disk.
+func openStore(conf config) (fsdb.Store, string) {
+	switch conf.store {
+	case "memory":
+		return fsdb.NewMemDB(), ""
+	case "file":
+		if mkdirErr := os.MkdirAll(conf.dataDir, 0o755); mkdirErr != nil {
+			log.Fatal("Could not create data directory: ", mkdirErr)
+		}
+		dbPath := conf.databasePath()
+		fileDB, dbErr := fsdb.Open(dbPath, conf.storeOptions())
+		if dbErr != nil {
+			log.Fatal("Could not open database connection", dbErr.Error())
+		}
+		if fileDB.Recovery != nil {
+			log.Printf("Recovered database: %s", fileDB.Recovery)
+		}
+		if fileDB.Migration != nil {
+			log.Printf("Upgraded database: %s", fileDB.Migration)
+		}
+		return fileDB, dbPath
+	default:
+		log.Fatalf("Unknown store: %s", conf.store)
+		return nil, ""
 	}
-	godotenv.Load()
+}
+
+func startServer(conf config, db fsdb.Store, readyChan chan struct{}) {
 	cfg := apiConfig{
-		fileServerHits: 0,
-		jwtSecret:      os.Getenv("JWT_SECRET"),
-		polkaApiKey:    os.Getenv("POLKA_API_KEY"),
-		db:             db,
+		fileServerHits:  0,
+		jwtSecret:       conf.jwtSecret,
+		polkaApiKey:     conf.polkaApiKey,
+		adminApiKey:     conf.adminApiKey,
+		accessTokenTTL:  conf.accessTokenTTL,
+		refreshTokenTTL: conf.refreshTokenTTL,
+		db:              db,
+		backupDir:       conf.backupDir,
+		backupsKept:     conf.backupsKept,
 	}
 
+	go cfg.pruneRevokedTokens(time.Hour)
+	go cfg.purgeDeletedChirps(time.Hour, deletedChirpRetention)
+
 	mainRouter := chi.NewRouter()
 	apiRouter := chi.NewRouter()
 	adminRouter := chi.NewRouter()
 
-	fileHandler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
+	// Only the static files are served: the database and its backups live
+	// in the working directory by default and must not be downloadable.
+	fileHandler := http.StripPrefix("/app", http.FileServer(http.Dir(staticDir)))
 	mainRouter.Handle("/app/*", cfg.middlewareMetricsIncrementer(fileHandler))
 	mainRouter.Handle("/app", cfg.middlewareMetricsIncrementer(fileHandler))
 
 	adminRouter.Get("/metrics", cfg.serveHitCountMetrics)
+	adminRouter.Group(func(r chi.Router) {
+		r.Use(cfg.middlewareAdminAuth)
+		r.Post("/backups", cfg.backupsPostHandler)
+		r.Get("/backups", cfg.backupsGetHandler)
+		r.Post("/backups/{backupName}/restore", cfg.backupsRestoreHandler)
+		r.Get("/chirps/deleted", cfg.deletedChirpsGetHandler)
+	})
 
 	apiRouter.Get("/healthz", readinessHandler)
 	apiRouter.HandleFunc("/reset", cfg.resetHitCountMetrics)
 
 	apiRouter.Post("/chirps", cfg.chirpsPostHandler)
 	apiRouter.Get("/chirps", cfg.chirpsGetHandler)
+	apiRouter.Get("/chirps/search", cfg.chirpsSearchHandler)
+	apiRouter.Get("/chirps/liked", cfg.likedChirpsGetHandler)
+	apiRouter.Get("/hashtags/{hashtag}/chirps", cfg.hashtagChirpsGetHandler)
 	apiRouter.Get("/chirps/{chirpId}", cfg.chirpsGetUniqueHandler)
+	apiRouter.Get("/chirps/{chirpId}/thread", cfg.chirpsThreadHandler)
 	apiRouter.Delete("/chirps/{chirpId}", cfg.chirpsDeleteHandler)
+	apiRouter.Post("/chirps/{chirpId}/undelete", cfg.chirpsUndeleteHandler)
+	apiRouter.Get("/chirps/{chirpId}/likes", cfg.likesGetHandler)
+	apiRouter.Post("/chirps/{chirpId}/likes", cfg.likesPostHandler)
+	apiRouter.Delete("/chirps/{chirpId}/likes", cfg.likesDeleteHandler)
 
 	apiRouter.Post("/users", cfg.createUserHandler)
 	apiRouter.Put("/users", cfg.updateUserHandler)
+	apiRouter.Get("/users/{userId}/mentions", cfg.mentionsGetHandler)
 	apiRouter.Post("/login", cfg.loginHandler)
 
 	apiRouter.Post("/refresh", cfg.refreshHandler)
@@ -74,36 +132,97 @@ func startServer(port string, debug bool, dbPathChan chan string) {
 
 	corsRouter := middlewareCors(mainRouter)
 
-	srv := &http.Server{Addr: ":" + port, Handler: corsRouter}
+	srv := &http.Server{Addr: ":" + conf.port, Handler: corsRouter}
 
-	log.Printf("Starting server on port: %s", port)
-	dbPathChan <- db.Path
+	log.Printf("Starting server on port: %s", conf.port)
+	readyChan <- struct{}{}
 	log.Fatal(srv.ListenAndServe())
 }
 
 func main() {
-	debugFlg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
+	conf, args, configErr := loadConfig(os.Args[1:])
+	if errors.Is(configErr, flag.ErrHelp) {
+		return
+	}
+	if configErr != nil {
+		log.Fatal(configErr)
+	}
+
+	if len(args) > 0 {
+		ctx := commandContext{
+			dbPath:           conf.databasePath(),
+			encryptionKey:    conf.encryptionKey,
+			sharded:          conf.sharded,
+			chirpSegmentSize: conf.chirpSegmentSize,
+			backupDir:        conf.backupDir,
+			backupsKept:      conf.backupsKept,
+		}
+		if cmdErr := runCommand(args, ctx); cmdErr != nil {
+			log.Fatal(cmdErr)
+		}
+		return
+	}
 
-	dbPathChan := make(chan string)
-	go startServer("8080", *debugFlg, dbPathChan)
+	if serverErr := conf.validateServer(); serverErr != nil {
+		log.Fatal(serverErr)
+	}
+	if conf.polkaApiKey == "" {
+		log.Print("POLKA_API_KEY is empty; Polka webhooks are disabled")
+	}
+
+	db, dbPath := openStore(conf)
+	if conf.ids != "" {
+		strategyErr := db.Update(func(tx *fsdb.Tx) error {
+			return tx.SetIdStrategy(fsdb.IdStrategy(conf.ids))
+		})
+		if strategyErr != nil {
+			log.Fatal("Could not change the id strategy: ", strategyErr)
+		}
+	}
+	readyChan := make(chan struct{})
+	go startServer(conf, db, readyChan)
 
-	dbPath := <-dbPathChan
+	<-readyChan
 	time.Sleep(20 * time.Millisecond)
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		fmt.Print("Type 'exit' to shut down the server > ")
-		scanner.Scan()
-		command := scanner.Text()
-		if command == "exit" {
-			if *debugFlg {
-				fmt.Printf("Deleting test database: %s\n", dbPath)
-				os.Remove(dbPath)
-			} else {
-				fmt.Printf("Database: %s persists\n", dbPath)
+	waitForShutdown()
+	if closeErr := db.Close(); closeErr != nil {
+		fmt.Printf("Could not close database: %s\n", closeErr)
+	}
+	if dbPath == "" {
+		fmt.Println("In-memory database discarded")
+	} else if conf.ephemeral {
+		fmt.Printf("Deleting test database: %s\n", dbPath)
+		fsdb.RemoveFiles(dbPath)
+	} else {
+		fmt.Printf("Database: %s persists\n", dbPath)
+	}
+}
+
+// waitForShutdown returns once 'exit' is typed or the process is asked to
+// stop. Without a terminal, only the signals are left.
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	exitTyped := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for {
+			fmt.Print("Type 'exit' to shut down the server > ")
+			if !scanner.Scan() {
+				fmt.Println()
+				log.Print("No more input; stop the server with Ctrl-C or SIGTERM")
+				return
+			}
+			if scanner.Text() == "exit" {
+				close(exitTyped)
+				return
 			}
-			break
 		}
+	}()
+	select {
+	case <-exitTyped:
+	case <-signals:
+		fmt.Println()
 	}
 }
@@ -6,6 +6,11 @@ import (
 )
 
 func (cfg *apiConfig) serveHitCountMetrics(w http.ResponseWriter, r *http.Request) {
+	revokedTokens, countErr := cfg.db.CountRevokedTokens()
+	if countErr != nil {
+		respondWithStoreError(w, countErr)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	responseBody := fmt.Sprintf(
@@ -14,10 +19,12 @@ func (cfg *apiConfig) serveHitCountMetrics(w http.ResponseWriter, r *http.Reques
 			<body>
 				<h1>Welcome, Chirpy Admin</h1>
 				<p>Chirpy has been visited %d times!</p>
+				<p>Revoked refresh tokens awaiting expiry: %d</p>
 			</body>
 
 		</html>`,
 		cfg.fileServerHits,
+		revokedTokens,
 	)
 	w.Write([]byte(responseBody))
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"strings"
 )
 
 func middlewareCors(next http.Handler) http.Handler {
@@ -23,3 +24,24 @@ func (cfg *apiConfig) middlewareMetricsIncrementer(next http.Handler) http.Handl
 		next.ServeHTTP(w, r)
 	})
 }
+
+// middlewareAdminAuth only lets requests through that carry the admin API key.
+// Without a configured key the protected endpoints are disabled.
+func (cfg *apiConfig) middlewareAdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.adminApiKey == "" {
+			respondWithError(w, 403, "Admin API is disabled")
+			return
+		}
+		authHeader := strings.Split(r.Header.Get("Authorization"), " ")
+		if len(authHeader) < 2 || authHeader[0] != "ApiKey" {
+			respondWithError(w, 401, "Missing authorization")
+			return
+		}
+		if authHeader[1] != cfg.adminApiKey {
+			respondWithError(w, 401, "Authorization failed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
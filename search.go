@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fsdb"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chirpsSearchHandler finds chirps by their text, best matches first unless
+// sort=recent. See fsdb.SearchQuery for what q can contain. Pages continue
+// like those of chirpsGetHandler.
+func (cfg *apiConfig) chirpsSearchHandler(w http.ResponseWriter, r *http.Request) {
+	query := fsdb.SearchQuery{
+		Text:     r.URL.Query().Get("q"),
+		AuthorId: r.URL.Query().Get("author_id"),
+		Order:    fsdb.SearchOrder(r.URL.Query().Get("sort")),
+	}
+	if query.Order == "" {
+		query.Order = fsdb.ByRelevance
+	}
+	var limitErr error
+	if query.Limit, limitErr = parseLimitParam(r); limitErr != nil {
+		respondWithError(w, 400, limitErr.Error())
+		return
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var cursorErr error
+		if query, cursorErr = decodeSearchCursor(cursor, query); cursorErr != nil {
+			respondWithError(w, 400, cursorErr.Error())
+			return
+		}
+	}
+
+	page, searchErr := cfg.db.SearchChirps(query)
+	if searchErr != nil {
+		respondWithStoreError(w, searchErr)
+		return
+	}
+	chirps := make([]fsdb.Chirp, 0, len(page.Hits))
+	for _, hit := range page.Hits {
+		chirps = append(chirps, hit.Chirp)
+	}
+	if page.More {
+		setNextLink(w, r, encodeSearchCursor(page, query.Order))
+	}
+	respondWithJSON(w, 200, chirps)
+}
+
+// A search cursor names the last hit of a page by its creation time and id
+// and, when ranking by relevance, its score along with the stats it was
+// scored with, so that the following pages are ranked the same way however
+// the chirps change in between.
+func encodeSearchCursor(page fsdb.SearchPage, order fsdb.SearchOrder) string {
+	last := page.Hits[len(page.Hits)-1]
+	position := strconv.FormatInt(last.Chirp.CreatedAt.UnixNano(), 10) + ":" + last.Chirp.Id
+	if order == fsdb.ByRelevance {
+		matches := make([]string, 0, len(page.Stats.Matches))
+		for _, count := range page.Stats.Matches {
+			matches = append(matches, strconv.Itoa(count))
+		}
+		position = strings.Join([]string{
+			strconv.Itoa(page.Stats.ChirpCount),
+			strconv.Itoa(page.Stats.WordCount),
+			strings.Join(matches, ","),
+			strconv.FormatFloat(last.Score, 'g', -1, 64),
+			position,
+		}, ":")
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(string(order) + ":" + position))
+}
+
+// decodeSearchCursor returns query continued behind the hit named by cursor.
+func decodeSearchCursor(cursor string, query fsdb.SearchQuery) (fsdb.SearchQuery, error) {
+	decoded, decodeErr := base64.RawURLEncoding.DecodeString(cursor)
+	if decodeErr != nil {
+		return query, errors.New("Invalid cursor")
+	}
+	cursorOrder, position, _ := strings.Cut(string(decoded), ":")
+	if fsdb.SearchOrder(cursorOrder) != query.Order {
+		return query, errors.New("Cursor belongs to a search in another order")
+	}
+	if query.Order == fsdb.ByRelevance {
+		parts := strings.SplitN(position, ":", 5)
+		if len(parts) != 5 {
+			return query, errors.New("Invalid cursor")
+		}
+		var chirpCountErr, wordCountErr, scoreErr error
+		query.Stats.ChirpCount, chirpCountErr = strconv.Atoi(parts[0])
+		query.Stats.WordCount, wordCountErr = strconv.Atoi(parts[1])
+		query.AfterScore, scoreErr = strconv.ParseFloat(parts[3], 64)
+		if chirpCountErr != nil || wordCountErr != nil || scoreErr != nil || query.Stats.ChirpCount < 1 {
+			return query, errors.New("Invalid cursor")
+		}
+		for _, count := range strings.Split(parts[2], ",") {
+			matches, atoiErr := strconv.Atoi(count)
+			if atoiErr != nil {
+				return query, errors.New("Invalid cursor")
+			}
+			query.Stats.Matches = append(query.Stats.Matches, matches)
+		}
+		position = parts[4]
+	}
+	createdAt, lastId, _ := strings.Cut(position, ":")
+	nanos, atoiErr := strconv.ParseInt(createdAt, 10, 64)
+	if atoiErr != nil || lastId == "" {
+		return query, errors.New("Invalid cursor")
+	}
+	query.AfterId, query.AfterCreatedAt = lastId, time.Unix(0, nanos).UTC()
+	return query, nil
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"errors"
-	"fmt"
-	"strconv"
+	"log"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -18,23 +19,23 @@ const (
 	TokenTypeRefresh TokenType = "chirpy-refresh"
 )
 
-func generateToken(issuer string, userId int, jwtSecret string, expirationDuration time.Duration) (string, error) {
+func generateToken(issuer string, userId string, jwtSecret string, expirationDuration time.Duration) (string, error) {
 	claims := jwt.RegisteredClaims{
 		Issuer:    issuer,
 		IssuedAt:  jwt.NewNumericDate(time.Now()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expirationDuration)),
-		Subject:   fmt.Sprintf("%d", userId),
+		Subject:   userId,
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(jwtSecret))
 }
 
-func generateAccessToken(userId int, jwtSecret string) (string, error) {
-	return generateToken(string(TokenTypeAccess), userId, jwtSecret, time.Hour)
+func (cfg *apiConfig) generateAccessToken(userId string) (string, error) {
+	return generateToken(string(TokenTypeAccess), userId, cfg.jwtSecret, cfg.accessTokenTTL)
 }
 
-func generateRefreshToken(userId int, jwtSecret string) (string, error) {
-	return generateToken(string(TokenTypeRefresh), userId, jwtSecret, time.Duration(24*60)*time.Hour)
+func (cfg *apiConfig) generateRefreshToken(userId string) (string, error) {
+	return generateToken(string(TokenTypeRefresh), userId, cfg.jwtSecret, cfg.refreshTokenTTL)
 }
 
 func (cfg *apiConfig) validateToken(token, expectedIssuer string) (*jwt.Token, error) {
@@ -53,18 +54,54 @@ func (cfg *apiConfig) validateToken(token, expectedIssuer string) (*jwt.Token, e
 	return parsedToken, nil
 }
 
+// pruneRevokedTokens periodically drops revocations of tokens that have
+// expired anyway. It never returns.
+func (cfg *apiConfig) pruneRevokedTokens(interval time.Duration) {
+	for range time.Tick(interval) {
+		pruned, pruneErr := cfg.db.PruneRevokedTokens(time.Now())
+		if pruneErr != nil {
+			log.Printf("Could not prune revoked tokens: %s", pruneErr)
+		} else if pruned > 0 {
+			log.Printf("Pruned %d expired revoked tokens", pruned)
+		}
+	}
+}
+
 func isIssuerRevokable(issuer string) bool {
 	return issuer == string(TokenTypeRefresh)
 }
 
-func getUserId(token *jwt.Token) (int, error) {
-	stringifiedUserId, subjectErr := token.Claims.GetSubject()
+// getUserId returns the id of the user a token was issued to. Tokens issued
+// while ids were numbers carry the number, which is still the user's id.
+func getUserId(token *jwt.Token) (string, error) {
+	userId, subjectErr := token.Claims.GetSubject()
 	if subjectErr != nil {
-		return 0, subjectErr
+		return "", subjectErr
 	}
-	userId, atoiErr := strconv.Atoi(stringifiedUserId)
-	if atoiErr != nil {
-		return 0, atoiErr
+	if userId == "" {
+		return "", errors.New("Token has no subject")
 	}
 	return userId, nil
 }
+
+// authenticateAccess returns the id of the user whose access token
+// authorizes r. If there is none, it responds with an error and reports
+// false.
+func (cfg *apiConfig) authenticateAccess(w http.ResponseWriter, r *http.Request) (string, bool) {
+	authHeader := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(authHeader) < 2 || authHeader[0] != "Bearer" {
+		respondWithError(w, 401, "Missing authorization")
+		return "", false
+	}
+	parsedToken, validationErr := cfg.validateToken(authHeader[1], string(TokenTypeAccess))
+	if validationErr != nil {
+		respondWithError(w, 401, validationErr.Error())
+		return "", false
+	}
+	userId, idErr := getUserId(parsedToken)
+	if idErr != nil {
+		respondWithError(w, 500, idErr.Error())
+		return "", false
+	}
+	return userId, true
+}
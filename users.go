@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-	"strconv"
-	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -14,6 +12,7 @@ func (cfg *apiConfig) createUserHandler(w http.ResponseWriter, r *http.Request)
 	reqBody := struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Handle   string `json:"handle"`
 	}{}
 	decoderErr := decoder.Decode(&reqBody)
 	if decoderErr != nil {
@@ -24,44 +23,24 @@ func (cfg *apiConfig) createUserHandler(w http.ResponseWriter, r *http.Request)
 	if hashErr != nil {
 		respondWithError(w, 500, hashErr.Error())
 	}
-	user, createErr := cfg.db.CreateUser(reqBody.Email, string(passwordHash))
+	user, createErr := cfg.db.CreateUser(reqBody.Email, string(passwordHash), reqBody.Handle)
 	if createErr != nil {
-		if createErr.Error() == "Unique email constraint" {
-			respondWithError(w, 409, "Email already in use")
-			return
-		}
-		respondWithError(w, 500, createErr.Error())
+		respondWithStoreError(w, createErr)
 		return
 	}
 	respondWithJSON(w, 201, user)
 }
 
 func (cfg *apiConfig) updateUserHandler(w http.ResponseWriter, r *http.Request) {
-	authHeader := strings.Split(r.Header.Get("Authorization"), " ")
-	if len(authHeader) < 2 || authHeader[0] != "Bearer" {
-		respondWithError(w, 401, "Missing authorization")
-		return
-	}
-	accessToken := authHeader[1]
-	token, validationErr := cfg.validateToken(accessToken, "chirpy-access")
-	if validationErr != nil || !token.Valid {
-		respondWithError(w, 401, validationErr.Error())
-		return
-	}
-	stringifiedUserId, subjectErr := token.Claims.GetSubject()
-	if subjectErr != nil {
-		respondWithJSON(w, 500, subjectErr.Error())
-		return
-	}
-	userId, atoiErr := strconv.Atoi(stringifiedUserId)
-	if atoiErr != nil {
-		respondWithJSON(w, 500, atoiErr.Error())
+	userId, ok := cfg.authenticateAccess(w, r)
+	if !ok {
 		return
 	}
 	decoder := json.NewDecoder(r.Body)
 	reqBody := struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Handle   string `json:"handle"`
 	}{}
 	decoderErr := decoder.Decode(&reqBody)
 	if decoderErr != nil {
@@ -73,9 +52,9 @@ func (cfg *apiConfig) updateUserHandler(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, 500, hashErr.Error())
 		return
 	}
-	user, updateErr := cfg.db.UpdateUser(userId, reqBody.Email, string(passwordHash))
+	user, updateErr := cfg.db.UpdateUser(userId, reqBody.Email, string(passwordHash), reqBody.Handle)
 	if updateErr != nil {
-		respondWithError(w, 500, updateErr.Error())
+		respondWithStoreError(w, updateErr)
 		return
 	}
 	respondWithJSON(w, 200, user)
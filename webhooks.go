@@ -2,11 +2,28 @@ package main
 
 import (
 	"encoding/json"
-	"fsdb"
 	"net/http"
 	"strings"
 )
 
+// flexibleId is an id sent by another service, which may still send it as a
+// number if it stored it while ids were numbers.
+type flexibleId string
+
+func (id *flexibleId) UnmarshalJSON(dat []byte) error {
+	var s string
+	if json.Unmarshal(dat, &s) == nil {
+		*id = flexibleId(s)
+		return nil
+	}
+	var number json.Number
+	if unmarshalErr := json.Unmarshal(dat, &number); unmarshalErr != nil {
+		return unmarshalErr
+	}
+	*id = flexibleId(number.String())
+	return nil
+}
+
 type EventType string
 
 const (
@@ -14,6 +31,10 @@ const (
 )
 
 func (cfg *apiConfig) polkaWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.polkaApiKey == "" {
+		respondWithError(w, 403, "Polka webhooks are disabled")
+		return
+	}
 	authHeader := strings.Split(r.Header.Get("Authorization"), " ")
 	if len(authHeader) < 2 || authHeader[0] != "ApiKey" {
 		respondWithError(w, 401, "Missing authorization")
@@ -28,7 +49,7 @@ func (cfg *apiConfig) polkaWebhookHandler(w http.ResponseWriter, r *http.Request
 	reqBody := struct {
 		Event string `json:"event"`
 		Data  struct {
-			UserId int `json:"user_id"`
+			UserId flexibleId `json:"user_id"`
 		} `json:"data"`
 	}{}
 	decoderErr := decoder.Decode(&reqBody)
@@ -40,13 +61,9 @@ func (cfg *apiConfig) polkaWebhookHandler(w http.ResponseWriter, r *http.Request
 		w.WriteHeader(200)
 		return
 	}
-	upgradeErr := cfg.db.UpgradeUser(reqBody.Data.UserId)
+	upgradeErr := cfg.db.UpgradeUser(string(reqBody.Data.UserId))
 	if upgradeErr != nil {
-		if upgradeErr.Error() == string(fsdb.UserNotExist) {
-			respondWithError(w, 404, "User doesn't exist")
-			return
-		}
-		respondWithError(w, 500, upgradeErr.Error())
+		respondWithStoreError(w, upgradeErr)
 		return
 	}
 	w.WriteHeader(200)